@@ -0,0 +1,191 @@
+package gee
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//路由的匹配条件， 路径匹配后再检查， 不满足时尝试同一路径的下一个路由
+type condition struct {
+	desc   string //条件描述， 如 header:X-API-Version=2 ， 用于检查重复路由和Routes()
+	status int    //路径匹配但只有该条件不满足时的状态码， 0表示按404处理
+	match  func(req *http.Request) bool
+}
+
+//注册路由时的选项， 通过 RouterGroup.With 传入
+type RouteOption func(*Route)
+
+//返回带有选项的路由组， 之后在该组注册的路由都会应用这些选项
+//如 r.With(gee.MatchHeader("X-API-Version", "2")).GET("/items", v2)
+func (group *RouterGroup) With(opts ...RouteOption) *RouterGroup {
+	options := make([]RouteOption, 0, len(group.options)+len(opts))
+	options = append(options, group.options...)
+	return &RouterGroup{
+		prefix:  group.prefix,
+		parent:  group,
+		engine:  group.engine,
+		host:    group.host,
+		options: append(options, opts...),
+	}
+}
+
+//请求头key的值等于value， value为空时只要求存在该请求头
+func MatchHeader(key string, value string) RouteOption {
+	return withCondition(condition{
+		desc: "header:" + http.CanonicalHeaderKey(key) + "=" + value,
+		match: func(req *http.Request) bool {
+			values, ok := req.Header[http.CanonicalHeaderKey(key)]
+			if !ok {
+				return false
+			}
+			if value == "" {
+				return true
+			}
+			for _, v := range values {
+				if v == value {
+					return true
+				}
+			}
+			return false
+		},
+	})
+}
+
+//查询参数key的值等于value， value为空时只要求存在该参数
+func MatchQuery(key string, value string) RouteOption {
+	return withCondition(condition{
+		desc: "query:" + key + "=" + value,
+		match: func(req *http.Request) bool {
+			values, ok := req.URL.Query()[key]
+			if !ok {
+				return false
+			}
+			if value == "" {
+				return true
+			}
+			for _, v := range values {
+				if v == value {
+					return true
+				}
+			}
+			return false
+		},
+	})
+}
+
+//请求的Content-Type为types之一， 忽略charset等参数； 都不满足时返回415
+func MatchContentType(types ...string) RouteOption {
+	return withCondition(condition{
+		desc:   "content-type:" + strings.Join(types, ","),
+		status: http.StatusUnsupportedMediaType,
+		match: func(req *http.Request) bool {
+			mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if err != nil {
+				return false
+			}
+			for _, t := range types {
+				if strings.EqualFold(mediaType, t) {
+					return true
+				}
+			}
+			return false
+		},
+	})
+}
+
+//请求的Accept接受types之一， 支持 */* 和 text/* ， 没有Accept时视为接受所有类型； 都不满足时返回406
+func MatchAccept(types ...string) RouteOption {
+	return withCondition(condition{
+		desc:   "accept:" + strings.Join(types, ","),
+		status: http.StatusNotAcceptable,
+		match: func(req *http.Request) bool {
+			accept := req.Header.Get("Accept")
+			if accept == "" {
+				return true
+			}
+			for _, item := range strings.Split(accept, ",") {
+				mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+				if err != nil || params["q"] == "0" {
+					continue
+				}
+				for _, t := range types {
+					if acceptsType(mediaType, t) {
+						return true
+					}
+				}
+			}
+			return false
+		},
+	})
+}
+
+func acceptsType(accepted string, t string) bool {
+	if accepted == "*/*" || strings.EqualFold(accepted, t) {
+		return true
+	}
+	return strings.HasSuffix(accepted, "/*") && strings.HasPrefix(strings.ToLower(t), strings.ToLower(accepted[:len(accepted)-1]))
+}
+
+//请求的协议为schemes之一， 如 https
+func MatchScheme(schemes ...string) RouteOption {
+	return withCondition(condition{
+		desc: "scheme:" + strings.Join(schemes, ","),
+		match: func(req *http.Request) bool {
+			scheme := "http"
+			if req.URL.Scheme != "" {
+				scheme = req.URL.Scheme
+			} else if req.TLS != nil {
+				scheme = "https"
+			}
+			for _, s := range schemes {
+				if strings.EqualFold(scheme, s) {
+					return true
+				}
+			}
+			return false
+		},
+	})
+}
+
+func withCondition(cond condition) RouteOption {
+	return func(route *Route) {
+		route.conditions = append(route.conditions, cond)
+	}
+}
+
+//请求是否满足路由的所有条件
+func (route *Route) matches(req *http.Request) bool {
+	for _, cond := range route.conditions {
+		if !cond.match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+//第一个不满足的条件对应的状态码
+func (route *Route) failedStatus(req *http.Request) int {
+	for _, cond := range route.conditions {
+		if !cond.match(req) {
+			return cond.status
+		}
+	}
+	return 0
+}
+
+//条件的签名， 同一路径和方法下签名相同的路由视为重复
+func (route *Route) signature() string {
+	descs := route.conditionDescs()
+	sort.Strings(descs)
+	return strings.Join(descs, " ")
+}
+
+func (route *Route) conditionDescs() []string {
+	descs := make([]string, len(route.conditions))
+	for i, cond := range route.conditions {
+		descs[i] = cond.desc
+	}
+	return descs
+}
@@ -0,0 +1,97 @@
+package gee
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//动态参数的约束， 如 /user/:id<int> 只匹配数字
+//<>或{}中的内容为已注册的约束名时使用该约束， 否则作为正则表达式匹配整个参数
+var constraints = map[string]func(string) bool{
+	"int":   isInt,
+	"alpha": regexp.MustCompile(`^[A-Za-z]+$`).MatchString,
+	"alnum": regexp.MustCompile(`^[A-Za-z0-9]+$`).MatchString,
+	"uuid":  regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`).MatchString,
+}
+
+//注册命名约束， 之后可以在路由中使用 :name<约束名> 或 {name:约束名}
+//需要在注册路由之前调用
+func RegisterConstraint(name string, match func(string) bool) {
+	if name == "" || match == nil {
+		panic("gee: constraint must have a name and a match function")
+	}
+	constraints[name] = match
+}
+
+func isInt(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//解析动态片段， 支持 :name、 :name<约束>、 {name}、 {name:约束} 和 *name
+//返回参数名和约束， 没有约束时为空字符串
+func parseWildcard(part string) (key string, constraint string) {
+	switch part[0] {
+	case '*':
+		return part[1:], ""
+	case '{':
+		if part[len(part)-1] != '}' {
+			panic(fmt.Sprintf("gee: wildcard %q must end with '}'", part))
+		}
+		key = part[1 : len(part)-1]
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key, constraint = key[:i], key[i+1:]
+		}
+	default:
+		key = part[1:]
+		if i := strings.IndexByte(key, '<'); i >= 0 {
+			if key[len(key)-1] != '>' {
+				panic(fmt.Sprintf("gee: wildcard %q must end with '>'", part))
+			}
+			key, constraint = key[:i], key[i+1:len(key)-1]
+		}
+	}
+	if key == "" {
+		panic(fmt.Sprintf("gee: wildcard %q must have a name", part))
+	}
+	return key, constraint
+}
+
+//路由中各动态片段的约束函数， 按出现的顺序， 没有约束的为nil
+//注册时编译一次， 查找路由和生成url时共用
+func compileChecks(pattern string) []func(string) bool {
+	var checks []func(string) bool
+	for i := nextWildcard(pattern); i >= 0; i = nextWildcard(pattern) {
+		end := i + wildcardEnd(pattern[i:])
+		_, constraint := parseWildcard(pattern[i:end])
+		checks = append(checks, compileConstraint(constraint))
+		pattern = pattern[end:]
+	}
+	return checks
+}
+
+//返回约束对应的匹配函数
+func compileConstraint(constraint string) func(string) bool {
+	if constraint == "" {
+		return nil
+	}
+	if match, ok := constraints[constraint]; ok {
+		return match
+	}
+	re, err := regexp.Compile("^(?:" + constraint + ")$")
+	if err != nil {
+		panic(fmt.Sprintf("gee: invalid constraint %q: %v", constraint, err))
+	}
+	return re.MatchString
+}
@@ -1,39 +1,91 @@
 package gee
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"sync"
+	"time"
 )
 
+//Abort后的index， 大于任何handler链的长度
+const abortIndex = math.MaxInt32 >> 1
+
 type H map[string]interface{}
 
 type Context struct {
 	//origin objects 源对象
-	Writer http.ResponseWriter
-	Req    *http.Request
+	Writer    ResponseWriter //响应的状态码和大小通过 Writer.Status() 和 Writer.Size() 获取
+	writermem responseWriter //Writer默认指向它， 随Context复用
+	Req       *http.Request
 	//请求信息
 	Path   string
 	Method string
-	Params map[string]string //存放动态路由键值对，方便调用（如 :name 对应的实际参数）
-	//响应信息
-	StatusCode int
+	Params Params //存放动态路由键值对，方便调用（如 :name 对应的实际参数）
 
 	//中间件
 	handlers []HandlerFunc //存放中间件， 方便最后通过上下文来调用
 	index    int
 
+	//在handler链中传递数据， 如认证后的用户， 通过Set和Get访问
+	mu   sync.RWMutex
+	Keys map[string]interface{}
+	//handler链中记录的错误， 如AbortWithError， Logger会输出
+	Errors []error
+
 	engine   *Engine //使context能通过engine访问html模板
+	route    *Route  //匹配到的路由， 未匹配时为nil
+
+	//未匹配到路由时默认handler使用的数据
+	redirectTo string //重定向的目标
+	rejectCode int    //路径匹配但条件不满足时的状态码
+}
+
+//Context从engine的对象池中取出， 请求结束后放回复用， 不能在handler返回后继续使用
+func (c *Context) reset(w http.ResponseWriter, req *http.Request) {
+	c.writermem.reset(w)
+	c.Writer = &c.writermem
+	c.Req = req
+	c.Path = req.URL.Path
+	c.Method = req.Method
+	c.Params = c.Params[:0]
+	c.handlers = nil
+	c.index = -1
+	c.route = nil
+	c.redirectTo = ""
+	c.rejectCode = 0
+	c.Keys = nil
+	c.Errors = c.Errors[:0]
 }
 
-func newContext(w http.ResponseWriter, req *http.Request) *Context {
-	return &Context{
-		Writer:     w,
-		Req:        req,
-		Path:       req.URL.Path,
-		Method:     req.Method,
-		index:      -1,
+//复制Context， 用于在新的goroutine中执行剩余的handler
+//Params单独复制， 原Context放回对象池后仍然有效
+func (c *Context) fork(w http.ResponseWriter, req *http.Request) *Context {
+	fork := &Context{
+		Req:      req,
+		Path:     c.Path,
+		Method:   c.Method,
+		Params:   append(Params(nil), c.Params...),
+		handlers: c.handlers,
+		index:    c.index,
+		engine:   c.engine,
+		route:    c.route,
+		Errors:   append([]error(nil), c.Errors...),
 	}
+	c.mu.RLock()
+	if c.Keys != nil {
+		fork.Keys = make(map[string]interface{}, len(c.Keys))
+		for k, v := range c.Keys {
+			fork.Keys[k] = v
+		}
+	}
+	c.mu.RUnlock()
+	fork.writermem.reset(w)
+	fork.writermem.status = c.Writer.Status()
+	fork.Writer = &fork.writermem
+	return fork
 }
 
 //调用中间件
@@ -47,15 +99,166 @@ func (c *Context) Next() {
 
 
 func (c *Context) Fail(code int, err string) {
-	c.index = len(c.handlers)
-	c.Json(code, H{"message":err})
+	c.AbortWithStatusJSON(code, H{"message":err})
+}
+
+//停止执行之后的handler， 当前handler会继续执行完
+//已经执行过的中间件在c.Next()返回后仍会执行剩余部分， 如Logger
+func (c *Context) Abort() {
+	c.index = abortIndex
+}
+
+//是否调用过Abort
+func (c *Context) IsAborted() bool {
+	return c.index >= abortIndex
+}
+
+//停止执行之后的handler并立即发送状态码， 如认证失败时返回401
+func (c *Context) AbortWithStatus(code int) {
+	c.Status(code)
+	c.Writer.WriteHeaderNow()
+	c.Abort()
+}
+
+//停止执行之后的handler并返回json
+func (c *Context) AbortWithStatusJSON(code int, obj interface{}) {
+	c.Abort()
+	c.Json(code, obj)
+}
+
+//停止执行之后的handler， 发送状态码并记录错误， 返回err以便直接return
+func (c *Context) AbortWithError(code int, err error) error {
+	c.AbortWithStatus(code)
+	c.Errors = append(c.Errors, err)
+	return err
+}
+
+//保存键值对， 之后的handler可以通过Get获取
+func (c *Context) Set(key string, value interface{}) {
+	c.mu.Lock()
+	if c.Keys == nil {
+		c.Keys = make(map[string]interface{})
+	}
+	c.Keys[key] = value
+	c.mu.Unlock()
+}
+
+//获取键对应的值， 第二个返回值表示是否存在
+func (c *Context) Get(key string) (value interface{}, exists bool) {
+	c.mu.RLock()
+	value, exists = c.Keys[key]
+	c.mu.RUnlock()
+	return
+}
+
+//获取键对应的值， 不存在时panic
+func (c *Context) MustGet(key string) interface{} {
+	if value, exists := c.Get(key); exists {
+		return value
+	}
+	panic("gee: key \"" + key + "\" does not exist")
+}
+
+//以下getter在键不存在或类型不符时返回零值
+func (c *Context) GetString(key string) (s string) {
+	if val, ok := c.Get(key); ok && val != nil {
+		s, _ = val.(string)
+	}
+	return
+}
+
+func (c *Context) GetBool(key string) (b bool) {
+	if val, ok := c.Get(key); ok && val != nil {
+		b, _ = val.(bool)
+	}
+	return
+}
+
+func (c *Context) GetInt(key string) (i int) {
+	if val, ok := c.Get(key); ok && val != nil {
+		i, _ = val.(int)
+	}
+	return
+}
+
+func (c *Context) GetInt64(key string) (i int64) {
+	if val, ok := c.Get(key); ok && val != nil {
+		i, _ = val.(int64)
+	}
+	return
+}
+
+func (c *Context) GetFloat64(key string) (f float64) {
+	if val, ok := c.Get(key); ok && val != nil {
+		f, _ = val.(float64)
+	}
+	return
+}
+
+func (c *Context) GetTime(key string) (t time.Time) {
+	if val, ok := c.Get(key); ok && val != nil {
+		t, _ = val.(time.Time)
+	}
+	return
+}
+
+func (c *Context) GetDuration(key string) (d time.Duration) {
+	if val, ok := c.Get(key); ok && val != nil {
+		d, _ = val.(time.Duration)
+	}
+	return
+}
+
+func (c *Context) GetStringSlice(key string) (ss []string) {
+	if val, ok := c.Get(key); ok && val != nil {
+		ss, _ = val.([]string)
+	}
+	return
+}
+
+func (c *Context) GetStringMap(key string) (sm map[string]interface{}) {
+	if val, ok := c.Get(key); ok && val != nil {
+		sm, _ = val.(map[string]interface{})
+	}
+	return
 }
 
 
 //获取动态路由对应参数， 如:name 对应的参数
 func (c *Context) Param(key string) string {
-	value , _ := c.Params[key]
-	return value
+	return c.Params.ByName(key)
+}
+
+//返回匹配到的路由， 如 /hello/:name ， 未匹配时为空字符串
+//用于日志和监控， 避免按实际路径统计时标签过多
+func (c *Context) FullPath() string {
+	if c.route == nil {
+		return ""
+	}
+	return c.route.pattern
+}
+
+//返回匹配到的路由名， 没有命名时为空字符串
+func (c *Context) RouteName() string {
+	if c.route == nil {
+		return ""
+	}
+	return c.route.loadAttrs().name
+}
+
+//返回匹配到的路由上的元数据
+func (c *Context) RouteMeta(key string) (interface{}, bool) {
+	if c.route == nil {
+		return nil, false
+	}
+	value, ok := c.route.loadAttrs().meta[key]
+	return value, ok
+}
+
+//获取动态路由对应参数， 第二个返回值表示参数是否存在
+//可选参数（如 /list/:page? ）没有出现时返回空字符串和false
+func (c *Context) GetParam(key string) (string, bool) {
+	return c.Params.Get(key)
 }
 
 func (c *Context) PostFrom(key string) string {
@@ -66,8 +269,8 @@ func (c *Context) Query(key string) string {
 	return c.Req.URL.Query().Get(key)  //解析url参数
 }
 
+//设置状态码， 响应头在第一次写入响应体或请求结束时发送
 func (c *Context) Status(code int) {
-	c.StatusCode = code
 	c.Writer.WriteHeader(code)
 }
 
@@ -76,19 +279,21 @@ func (c *Context) SetHeader(key string, value string) {
 }
 
 func (c *Context) String(code int, format string, value ...interface{}) {
-	c.SetHeader("Content-Type", "test/plain")
+	c.SetHeader("Content-Type", "text/plain")
 	c.Status(code)
 	c.Writer.Write([]byte(fmt.Sprintf(format, value...)))
 }
 
+//先编码到缓冲中， 失败时还可以返回500
 func (c *Context) Json(code int, obj interface{})  {
-	c.SetHeader("Content", "application/json")
-	c.Status(code)
-	encoder := json.NewEncoder(c.Writer)
-	err := encoder.Encode(obj)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(obj); err != nil {
 		http.Error(c.Writer, err.Error(), 500)
+		return
 	}
+	c.SetHeader("Content-Type", "application/json")
+	c.Status(code)
+	c.Writer.Write(buf.Bytes())
 }
 
 func (c *Context) Data(code int, data []byte)  {
@@ -97,16 +302,25 @@ func (c *Context) Data(code int, data []byte)  {
 }
 
 //html template render
+//先渲染到缓冲中， 出错时响应头还没有发送， 可以返回500
 func (c *Context) HTML(code int, name string, data interface{})  {
-	c.SetHeader("Content-Type", "text/html")
-	c.Status(code)
-
-	//ExecuteTemplate: 将指定name的模板解析并应用于data，并将输出写到c.Writer
-	if err := c.engine.htmlTemplates.ExecuteTemplate(c.Writer, name, data); err != nil {
+	var buf bytes.Buffer
+	//ExecuteTemplate: 将指定name的模板解析并应用于data，并将输出写到buf
+	if err := c.engine.htmlTemplates.ExecuteTemplate(&buf, name, data); err != nil {
 		c.Fail(500, err.Error())
+		return
 	}
+	c.SetHeader("Content-Type", "text/html")
+	c.Status(code)
+	c.Writer.Write(buf.Bytes())
 }
 
+//HEAD请求丢弃响应体， 只保留状态码和响应头
+type headResponseWriter struct {
+	ResponseWriter
+}
 
-
-
+func (w headResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	return len(data), nil
+}
@@ -1,11 +1,15 @@
 package gee
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 //定义请求处理方法
@@ -13,6 +17,13 @@ import (
 //参数是ResponseWriter ，利用 ResponseWriter 可以构造针对该请求的响应。
 type HandlerFunc func(*Context)
 
+//Any注册的所有标准请求方法
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodHead, http.MethodOptions, http.MethodDelete,
+	http.MethodConnect, http.MethodTrace,
+}
+
 //路由部分
 //在golang中有个Handler的概念，一个URL对应一个Handler，在Handler中处理request的具体逻辑，对应关系保存在一个map结构中
 
@@ -23,24 +34,68 @@ type (
 		middlewares []HandlerFunc //支持中间件（中间件就是 自定义/默认定义处理程序（HandlerFunc）），
 		parent 		*RouterGroup  //支持嵌套
 		engine 		*Engine       //所有group共享一个Engine实例
+		host        *host         //组所属的域名， 路由注册到该域名的路由树
+		options     []RouteOption //该组下注册路由时应用的选项， 子组继承
 	}
 
 	Engine struct {
 		router 		*router
 		*RouterGroup
 		groups 		[]*RouterGroup //存储所有组
+		host          *host   //默认域名， router为其路由树
+		hosts         atomic.Value //Host注册的域名[]*host， 修改时复制后整体替换
+		names         map[string]*Route //命名路由， 用于生成url
+		mu            sync.RWMutex      //保护names、groups和hosts的修改， 服务运行时也可以添加和删除路由
 
 		htmlTemplates *template.Template //对html渲染 (生成安全的html片段)
 		funcMap      template.FuncMap //对html渲染 (定义从名称到函数的映射)
 		//htmlTemplates将所有的模板加载进内存，funcMap是所有的自定义模板渲染函数。
+
+		pool sync.Pool //复用Context， 减少每个请求的内存分配
+
+		//路径存在但请求方法不匹配时返回405并设置Allow头， 否则返回404
+		HandleMethodNotAllowed bool
+		noMethod               []HandlerFunc //自定义405处理
+
+		//未匹配到路由时的默认handler链， 已合并全局中间件， 在全局中间件或NoMethod改变时重新生成
+		notFoundHandlers []HandlerFunc
+		noMethodHandlers []HandlerFunc
+		optionsHandlers  []HandlerFunc
+		redirectHandlers []HandlerFunc
+		rejectHandlers   []HandlerFunc
+		//路径存在但没有注册OPTIONS时自动返回Allow头
+		HandleOptions bool
+
+		//请求路径和路由只差结尾的斜杠时重定向， 如 /hello/ 到 /hello
+		RedirectTrailingSlash bool
+		//未匹配时清理路径（. .. 和多余的斜杠）并忽略大小写查找， 找到则重定向
+		RedirectFixedPath bool
+		//路径含有多余的斜杠时重定向， 如 //hello 到 /hello
+		RemoveExtraSlash bool
+
+		//使用转义后的URL.RawPath匹配路由， c.Path也为RawPath
+		//如 /files/a%2Fb 匹配 /files/:key 而不是 /files/a/b
+		UseRawPath bool
+		//UseRawPath时对参数值解码， 如 a%2Fb 解码为 a/b ， 默认开启
+		UnescapePathValues bool
+
+		//静态片段忽略大小写， 如 /Products/Shoes 匹配 /products/:name ， 参数值保持原样
+		CaseInsensitive bool
+		//CaseInsensitive时重定向到注册时的大小写， 否则直接处理请求
+		RedirectCaseInsensitive bool
 	}
 )
 
 //构造函数
 func New() *Engine {
-	 engine := &Engine{router: newRouter()}
-	 engine.RouterGroup = &RouterGroup{engine: engine}
+	 engine := &Engine{router: newRouter(), names: make(map[string]*Route), UnescapePathValues: true}
+	 engine.host = &host{router: engine.router}
+	 engine.RouterGroup = &RouterGroup{engine: engine, host: engine.host}
 	 engine.groups = []*RouterGroup{engine.RouterGroup}
+	 engine.rebuildFallbacks()
+	 engine.pool.New = func() interface{} {
+		return &Context{engine: engine, Params: make(Params, 0, engine.router.load().maxParams)}
+	 }
 	 return engine
 }
 
@@ -52,8 +107,43 @@ func Default() *Engine {
 }
 
 //在路由组中添加中间件
+//中间件只作用于之后注册的路由和NoRoute， 已注册路由的handler链不会改变
+//全局中间件同时作用于默认的404、405、OPTIONS和重定向
 func (group *RouterGroup) Use(middleware ...HandlerFunc)  {
 	group.middlewares = append(group.middlewares, middleware...)
+	if group == group.engine.RouterGroup {
+		group.engine.rebuildFallbacks()
+	}
+}
+
+//合并默认handler和全局中间件， 处理请求时直接使用
+func (engine *Engine) rebuildFallbacks() {
+	noMethod := engine.noMethod
+	if len(noMethod) == 0 {
+		noMethod = []HandlerFunc{methodNotAllowedHandler}
+	}
+	engine.notFoundHandlers = engine.combineHandlers([]HandlerFunc{notFoundHandler})
+	engine.noMethodHandlers = engine.combineHandlers(noMethod)
+	engine.optionsHandlers = engine.combineHandlers([]HandlerFunc{optionsHandler})
+	engine.redirectHandlers = engine.combineHandlers([]HandlerFunc{redirectHandler})
+	engine.rejectHandlers = engine.combineHandlers([]HandlerFunc{rejectHandler})
+}
+
+//合并出完整的handler链， 顺序为： 上层组的中间件、本组的中间件、handlers
+//注册路由时调用一次， 处理请求时不再遍历路由组
+func (group *RouterGroup) combineHandlers(handlers []HandlerFunc) []HandlerFunc {
+	groups := make([]*RouterGroup, 0)
+	size := len(handlers)
+	for g := group; g != nil; g = g.parent {
+		groups = append(groups, g)
+		size += len(g.middlewares)
+	}
+
+	merged := make([]HandlerFunc, 0, size)
+	for i := len(groups) - 1; i >= 0; i-- {
+		merged = append(merged, groups[i].middlewares...)
+	}
+	return append(merged, handlers...)
 }
 
 func (group *RouterGroup) Group(prefix string) *RouterGroup {
@@ -62,31 +152,111 @@ func (group *RouterGroup) Group(prefix string) *RouterGroup {
 		prefix:      group.prefix + prefix,
 		parent:      group,
 		engine:      engine,
+		host:        group.host,
+		options:     group.options,
 	}
+	engine.mu.Lock()
 	engine.groups = append(engine.groups, newGroup)
+	engine.mu.Unlock()
 	return newGroup
 }
 
-//路由映射表
-func (group *RouterGroup) addRouter(method string, comp string, handler HandlerFunc)  {
+//创建组下的路由
+//最后一个handler处理请求， 前面的作为该路由独有的中间件， 在组中间件之后执行
+func (group *RouterGroup) newRoute(method string, comp string, handlers []HandlerFunc) *Route {
 	pattern := group.prefix + comp
-	log.Printf("Route %4s - %s", method, pattern)
-	group.engine.router.addRoute(method, pattern, handler)
+	if len(handlers) == 0 {
+		panic(fmt.Sprintf("gee: route %s %s must have at least one handler", method, pattern))
+	}
+	route := &Route{pattern: pattern, handlers: group.combineHandlers(handlers), engine: group.engine}
+	for _, opt := range group.options {
+		opt(route)
+	}
+	route.applyPolicies(len(route.handlers) - len(handlers))
+	return route
+}
+
+//路由映射表
+func (group *RouterGroup) addRouter(method string, comp string, handlers []HandlerFunc) *Route {
+	route := group.newRoute(method, comp, handlers)
+	group.host.router.insertRoute(route, method)
+	return route
 }
 
 //GET请求方法
-func (group *RouterGroup) GET(pattern string, handler HandlerFunc)  {
-	group.addRouter("GET", pattern, handler)
+func (group *RouterGroup) GET(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("GET", pattern, handlers)
 }
 
 //POST请求方法
-func (group *RouterGroup) POST(pattern string, handler HandlerFunc)  {
-	group.addRouter("POST", pattern, handler)
+func (group *RouterGroup) POST(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("POST", pattern, handlers)
+}
+
+//PUT请求方法
+func (group *RouterGroup) PUT(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("PUT", pattern, handlers)
 }
 
+//DELETE请求方法
+func (group *RouterGroup) DELETE(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("DELETE", pattern, handlers)
+}
 
-//定义http服务器启动方法
+//PATCH请求方法
+func (group *RouterGroup) PATCH(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("PATCH", pattern, handlers)
+}
+
+//HEAD请求方法
+func (group *RouterGroup) HEAD(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("HEAD", pattern, handlers)
+}
+
+//OPTIONS请求方法
+func (group *RouterGroup) OPTIONS(pattern string, handlers ...HandlerFunc) *Route {
+	return group.addRouter("OPTIONS", pattern, handlers)
+}
+
+//任意请求方法， 可用于PROPFIND等自定义方法
+func (group *RouterGroup) Handle(method string, pattern string, handlers ...HandlerFunc) *Route {
+	if method == "" || strings.ContainsAny(method, " /\t\r\n") {
+		panic("gee: invalid http method " + strconv.Quote(method))
+	}
+	return group.addRouter(method, pattern, handlers)
+}
+
+//为所有标准请求方法注册同一组handler
+//所有方法共用返回的Route， 命名时对所有方法生效
+func (group *RouterGroup) Any(pattern string, handlers ...HandlerFunc) *Route {
+	route := group.newRoute("ANY", pattern, handlers)
+	group.host.router.insertRoute(route, anyMethods...)
+	return route
+}
+
+
+//设置该组下404时的处理函数， 会经过该组及上层组中已添加的中间件
+//按段匹配组前缀， 如 /v10/x 不属于 /v1 ； 未设置时使用上层组的NoRoute
+func (group *RouterGroup) NoRoute(handlers ...HandlerFunc) {
+	route := &Route{
+		pattern:  strings.TrimRight(group.prefix, "/") + "/*path?",
+		handlers: group.combineHandlers(handlers),
+		engine:   group.engine,
+	}
+	group.host.router.setNoRoute(route)
+}
+
+//设置405时的处理函数， 会经过全局中间件
+func (engine *Engine) NoMethod(handlers ...HandlerFunc) {
+	engine.noMethod = handlers
+	engine.rebuildFallbacks()
+}
+
+//定义http服务器启动方法， 启动前输出所有路由
 func (engine *Engine) Run(addr string) (err error) {
+	for _, route := range engine.Routes() {
+		log.Printf("Route %4s - %s%s --> %s (%d handlers)", route.Method, route.Host, route.Path, route.Handler, len(route.Middlewares)+1)
+	}
 	return http.ListenAndServe(addr, engine)
 }
 
@@ -94,20 +264,44 @@ func (engine *Engine) Run(addr string) (err error) {
 	ServeHTTP(w ResponseWriter, r *Request)
 }*/
 //实现ServeHTTP方法
+//handler链在注册路由时已经确定， 由router根据匹配结果设置
 func (engine *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request)  {
-	var middlewares []HandlerFunc
-	for _, group := range engine.groups{
-
-		if strings.HasPrefix(req.URL.Path, group.prefix) {
+	c := engine.pool.Get().(*Context)
+	c.reset(w, req)
+	engine.handleHTTPRequest(c)
+	c.writermem.WriteHeaderNow() //handler只设置了状态码时发送响应头
+	engine.pool.Put(c)
+}
 
-			middlewares = append(middlewares, group.middlewares...)
+//先在请求域名的路由树中查找， 没有匹配的路由且该域名没有设置NoRoute时使用默认域名
+func (engine *Engine) handleHTTPRequest(c *Context) {
+	if engine.UseRawPath && c.Req.URL.RawPath != "" {
+		c.Path = c.Req.URL.RawPath
+	}
+	if h := engine.matchHost(c.Req.Host, &c.Params); h != nil {
+		if h.router.handle(c) {
+			c.Next()
+			return
+		}
+		if route := h.router.getNoRoute(c.Path); route != nil {
+			c.handlers = route.handlers
+			c.Status(http.StatusNotFound) //NoRoute的handler没有设置状态码时也返回404
+			c.Next()
+			return
 		}
+		c.Params = c.Params[:0]
 	}
 
-	c := newContext(w, req)
-	c.handlers = middlewares
-	c.engine = engine
-	engine.router.handle(c)
+	if !engine.router.handle(c) {
+		if route := engine.router.getNoRoute(c.Path); route != nil {
+			c.handlers = route.handlers
+			c.Status(http.StatusNotFound) //NoRoute的handler没有设置状态码时也返回404
+		} else {
+			c.handlers = engine.notFoundHandlers
+		}
+	}
+	//通过context调用handlerFunc
+	c.Next()
 }
 
 //创建静态handler
@@ -127,11 +321,11 @@ func (group *RouterGroup) createStaticHandler(relativePath string, fs http.FileS
 }
 
 
-func (group *RouterGroup) Static(relativePath string, root string) {
+func (group *RouterGroup) Static(relativePath string, root string) *Route {
 	handler := group.createStaticHandler(relativePath, http.Dir(root))
 
 	urlPattern := path.Join(relativePath, "/*filepath")
-	group.GET(urlPattern, handler)//添加路由映射
+	return group.GET(urlPattern, handler)//添加路由映射
 }
 
 //设置自定义渲染函数funcMap
@@ -140,8 +334,13 @@ func (engine *Engine) SetFuncMap(funcMap template.FuncMap) {
 }
 
 //加载模板的方法
+//模板中可以使用 urlFor 根据路由名生成url， 如 {{urlFor "user.show" "id" 1}}
 func (engine *Engine) LoadHTMLGlob(pattern string) {
-	engine.htmlTemplates = template.Must(template.New("").Funcs(engine.funcMap).ParseGlob(pattern))
+	funcMap := template.FuncMap{"urlFor": engine.urlFor}
+	for name, fn := range engine.funcMap {
+		funcMap[name] = fn
+	}
+	engine.htmlTemplates = template.Must(template.New("").Funcs(funcMap).ParseGlob(pattern))
 }
 
 
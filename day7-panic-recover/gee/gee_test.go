@@ -1,6 +1,20 @@
 package gee
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestNestedGroup(t *testing.T) {
 	r := New()
@@ -14,3 +28,1170 @@ func TestNestedGroup(t *testing.T) {
 		t.Fatal("v2 prefix should be /v1/v2")
 	}
 }
+
+func TestHTTPMethods(t *testing.T) {
+	r := New()
+	r.PUT("/put", func(c *Context) { c.String(http.StatusOK, "put") })
+	r.DELETE("/delete", func(c *Context) { c.String(http.StatusOK, "delete") })
+	r.PATCH("/patch", func(c *Context) { c.String(http.StatusOK, "patch") })
+	r.HEAD("/head", func(c *Context) { c.Status(http.StatusOK) })
+	r.OPTIONS("/options", func(c *Context) { c.String(http.StatusOK, "options") })
+	r.Handle("PROPFIND", "/dav", func(c *Context) { c.String(http.StatusOK, "propfind") })
+	r.Any("/any", func(c *Context) { c.String(http.StatusOK, c.Method) })
+
+	cases := []struct {
+		method, path, body string
+	}{
+		{"PUT", "/put", "put"},
+		{"DELETE", "/delete", "delete"},
+		{"PATCH", "/patch", "patch"},
+		{"HEAD", "/head", ""},
+		{"OPTIONS", "/options", "options"},
+		{"PROPFIND", "/dav", "propfind"},
+		{"GET", "/any", "GET"},
+		{"DELETE", "/any", "DELETE"},
+		{"TRACE", "/any", "TRACE"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tc.body {
+			t.Fatalf("%s %s: got %d %q", tc.method, tc.path, w.Code, w.Body.String())
+		}
+	}
+
+	if len(r.router.getRoutes("PROPFIND")) != 1 {
+		t.Fatal("PROPFIND route should be listed")
+	}
+	for _, method := range anyMethods {
+		if len(r.router.getRoutes(method)) == 0 {
+			t.Fatalf("%s /any should be listed", method)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := New()
+	r.GET("/user/:id", func(c *Context) {})
+	r.PUT("/user/:id", func(c *Context) {})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/user/1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("405 handling is disabled by default, got %d", w.Code)
+	}
+
+	r.HandleMethodNotAllowed = true
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/user/1", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, PUT" {
+		t.Fatalf("expected 405 with Allow: GET, HEAD, PUT, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/nothing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path should still be 404, got %d", w.Code)
+	}
+
+	var order []string
+	r.Use(func(c *Context) {
+		order = append(order, "global")
+		c.Next()
+	})
+	r.NoMethod(func(c *Context) {
+		order = append(order, "noMethod")
+		c.Json(http.StatusMethodNotAllowed, H{"allow": c.Writer.Header().Get("Allow")})
+	})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/user/1", nil))
+	if w.Code != http.StatusMethodNotAllowed || strings.Join(order, ",") != "global,noMethod" {
+		t.Fatalf("NoMethod should run after global middleware, got %d %v", w.Code, order)
+	}
+}
+
+func TestNoRoute(t *testing.T) {
+	r := New()
+	var called []string
+	r.Use(func(c *Context) {
+		called = append(called, "global")
+		c.Next()
+	})
+	r.NoRoute(func(c *Context) {
+		c.HTML(http.StatusNotFound, "404.tmpl", nil)
+	})
+	r.htmlTemplates = template.Must(template.New("404.tmpl").Parse("<h1>not found</h1>"))
+	api := r.Group("/api")
+	api.Use(func(c *Context) {
+		called = append(called, "api")
+		c.Next()
+	})
+	api.NoRoute(func(c *Context) {
+		c.Json(http.StatusNotFound, H{"message": "not found"})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/users", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("api group should answer 404 in json, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if strings.Join(called, ",") != "global,api" {
+		t.Fatalf("NoRoute should run through group middleware, got %v", called)
+	}
+
+	called = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/about", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>not found</h1>" {
+		t.Fatalf("site root should render html 404, got %d %q", w.Code, w.Body.String())
+	}
+	if strings.Join(called, ",") != "global" {
+		t.Fatalf("site NoRoute should only see global middleware, got %v", called)
+	}
+
+	//NoRoute的handler链在设置时确定， 之后添加的中间件不影响
+	api.Use(func(c *Context) {
+		called = append(called, "late")
+		c.Next()
+	})
+	for path, expected := range map[string]string{"/api": "global,api", "/api/x/y": "global,api", "/apix": "global"} {
+		called = nil
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if strings.Join(called, ",") != expected {
+			t.Fatalf("%s: expected %s, got %v", path, expected, called)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.router.getNoRoute("/api/users")
+	})
+	if allocs != 0 {
+		t.Fatalf("NoRoute lookup should not allocate, got %v allocs", allocs)
+	}
+
+	//NoRoute的handler没有设置状态码时返回404， 明确设置时以handler为准
+	r.Group("/docs").NoRoute(func(c *Context) { c.Writer.Write([]byte("missing doc")) })
+	r.Group("/spa").NoRoute(func(c *Context) { c.String(http.StatusOK, "index") })
+	r.Host("docs.example.com").NoRoute(func(c *Context) { c.Writer.Write([]byte("missing page")) })
+	cases := []struct {
+		host, path string
+		code       int
+	}{
+		{"", "/docs/x", http.StatusNotFound},
+		{"", "/spa/x", http.StatusOK},
+		{"docs.example.com", "/x", http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Fatalf("%s%s: expected %d, got %d", tc.host, tc.path, tc.code, w.Code)
+		}
+	}
+}
+
+func TestAutoHeadAndOptions(t *testing.T) {
+	r := New()
+	r.GET("/hello", func(c *Context) {
+		c.SetHeader("X-Hello", "gee")
+		c.String(http.StatusOK, "hello")
+	})
+	r.POST("/hello", func(c *Context) {})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("HEAD", "/hello", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Hello") != "gee" || w.Body.Len() != 0 {
+		t.Fatalf("HEAD should run GET handler without body, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/hello", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("automatic OPTIONS is disabled by default, got %d", w.Code)
+	}
+
+	r.HandleOptions = true
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/hello", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Fatalf("expected 204 with Allow: GET, HEAD, OPTIONS, POST, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/nothing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("OPTIONS on unknown path should be 404, got %d", w.Code)
+	}
+}
+
+func TestRedirectPath(t *testing.T) {
+	r := New()
+	r.GET("/hello", func(c *Context) { c.String(http.StatusOK, c.Path) })
+	r.GET("/v1/", func(c *Context) { c.String(http.StatusOK, c.Path) })
+	r.POST("/Users/:name/Profile", func(c *Context) { c.String(http.StatusOK, c.Param("name")) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hello/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "/hello/" {
+		t.Fatalf("redirects are disabled by default, got %d %q", w.Code, w.Body.String())
+	}
+
+	r.RedirectTrailingSlash = true
+	r.RedirectFixedPath = true
+	r.RemoveExtraSlash = true
+	cases := []struct {
+		method, path string
+		code         int
+		location     string
+	}{
+		{"GET", "/hello/", http.StatusMovedPermanently, "/hello"},
+		{"GET", "/v1", http.StatusMovedPermanently, "/v1/"},
+		{"GET", "//hello?a=1", http.StatusMovedPermanently, "/hello?a=1"},
+		{"GET", "/HELLO", http.StatusMovedPermanently, "/hello"},
+		{"GET", "/v1/../hello", http.StatusMovedPermanently, "/hello"},
+		{"POST", "/users/GeeKtutu/profile", http.StatusPermanentRedirect, "/Users/GeeKtutu/Profile"},
+		{"GET", "/hello", http.StatusOK, ""},
+		{"GET", "/nothing", http.StatusNotFound, ""},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.code || w.Header().Get("Location") != tc.location {
+			t.Fatalf("%s %s: expected %d %q, got %d %q", tc.method, tc.path, tc.code, tc.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	//重定向不能指向其他域名， 路径中的特殊字符需要转义
+	r = New()
+	r.GET("/:name", func(c *Context) { c.String(http.StatusOK, c.Param("name")) })
+	r.RedirectTrailingSlash = true
+	redirects := map[string]string{
+		"//evil.com/":      "/evil.com",
+		"///evil.com/?a=1": "/evil.com?a=1",
+		"/%5Cevil.com/":    "/%5Cevil.com",
+		"/a%3Fb/?c=1":      "/a%3Fb?c=1",
+		"/a%20b/":          "/a%20b",
+	}
+	for path, location := range redirects {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+			t.Fatalf("%s: expected redirect to %q, got %d %q", path, location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRouteHandlers(t *testing.T) {
+	r := New()
+	var order []string
+	mark := func(name string) HandlerFunc {
+		return func(c *Context) {
+			order = append(order, name)
+			c.Next()
+		}
+	}
+	r.Use(mark("global"))
+	auth := func(c *Context) {
+		order = append(order, "auth")
+		if c.Query("token") == "" {
+			c.Fail(http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		c.Next()
+	}
+	r.GET("/admin", mark("validate"), auth, func(c *Context) {
+		order = append(order, "handler")
+		c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/admin?token=1", nil))
+	if w.Code != http.StatusOK || strings.Join(order, ",") != "global,validate,auth,handler" {
+		t.Fatalf("route handlers should run after group middleware, got %d %v", w.Code, order)
+	}
+
+	order = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != http.StatusUnauthorized || strings.Join(order, ",") != "global,validate,auth" {
+		t.Fatalf("route middleware should be able to stop the chain, got %d %v", w.Code, order)
+	}
+
+	if n, _ := r.router.getRoute("GET", "/admin"); n == nil || len(n.routes[0].handlers) != 4 {
+		t.Fatal("route should keep the group middleware and all of its handlers")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a route without handlers should panic")
+		}
+	}()
+	r.GET("/empty")
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	r := New()
+	var order []string
+	mark := func(name string) HandlerFunc {
+		return func(c *Context) {
+			order = append(order, name)
+			c.Next()
+		}
+	}
+	ok := func(c *Context) { c.String(http.StatusOK, "ok") }
+
+	r.Use(mark("global"))
+	v1 := r.Group("/v1")
+	v1.Use(mark("v1"))
+	admin := v1.Group("/admin")
+	admin.Use(mark("admin"))
+	admin.GET("/users", mark("route"), ok)
+	v1.GET("/ping", ok)
+	r.GET("/v10/x", ok)
+	//注册之后添加的中间件不影响已注册的路由
+	v1.Use(mark("late"))
+	v1.GET("/late", ok)
+
+	cases := []struct {
+		path  string
+		order string
+	}{
+		{"/v1/admin/users", "global,v1,admin,route"},
+		{"/v1/ping", "global,v1"},
+		{"/v10/x", "global"},
+		{"/v1/late", "global,v1,late"},
+		{"/v1/nothing", "global"},
+	}
+	for _, tc := range cases {
+		order = nil
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil))
+		if strings.Join(order, ",") != tc.order {
+			t.Fatalf("%s: expected %s, got %v", tc.path, tc.order, order)
+		}
+	}
+}
+
+func TestOptionalParams(t *testing.T) {
+	r := New()
+	r.GET("/list/:page<int>?", func(c *Context) {
+		page, ok := c.GetParam("page")
+		c.String(http.StatusOK, "%s %t", page, ok)
+	})
+	r.GET("/docs/*path?", func(c *Context) {
+		path, ok := c.GetParam("path")
+		c.String(http.StatusOK, "%s %t", path, ok)
+	})
+
+	cases := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/list", http.StatusOK, " false"},
+		{"/list/2", http.StatusOK, "2 true"},
+		{"/list/two", http.StatusNotFound, ""},
+		{"/docs", http.StatusOK, " false"},
+		{"/docs/guide/start.md", http.StatusOK, "guide/start.md true"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code || tc.body != "" && w.Body.String() != tc.body {
+			t.Fatalf("%s: expected %d %q, got %d %q", tc.path, tc.code, tc.body, w.Code, w.Body.String())
+		}
+	}
+
+	for _, pattern := range []string{"/list", "/docs/*path"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s should conflict with the optional route", pattern)
+				}
+			}()
+			r.GET(pattern, func(c *Context) {})
+		}()
+	}
+	for _, pattern := range []string{"/a/:id?/b", "/a/x:id?"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s should panic", pattern)
+				}
+			}()
+			r.GET(pattern, func(c *Context) {})
+		}()
+	}
+}
+
+func TestNamedRoutes(t *testing.T) {
+	r := New()
+	r.GET("/user/:id<int>", func(c *Context) {}).Name("user.show")
+	r.GET("/files/:name.:ext", func(c *Context) {}).Name("file")
+	r.GET("/list/:page?", func(c *Context) {}).Name("list")
+	r.Static("/assets", "./static").Name("assets")
+	r.Group("/v1").Any("/ping", func(c *Context) {}).Name("ping")
+	r.GET("/post/{year:[0-9]{4}}/:slug<[a-z0-9-]+>", func(c *Context) {}).Name("post")
+
+	cases := []struct {
+		name   string
+		params []string
+		url    string
+	}{
+		{"user.show", []string{"id", "42"}, "/user/42"},
+		{"user.show", []string{"id", "42", "tab", "a b"}, "/user/42?tab=a+b"},
+		{"file", []string{"name", "a b/c", "ext", "txt"}, "/files/a%20b%2Fc.txt"},
+		{"list", nil, "/list"},
+		{"list", []string{"page", "2"}, "/list/2"},
+		{"assets", []string{"filepath", "css/my file.css"}, "/assets/css/my%20file.css"},
+		{"ping", nil, "/v1/ping"},
+		{"post", []string{"year", "2024", "slug", "hello-gee"}, "/post/2024/hello-gee"},
+	}
+	for _, tc := range cases {
+		u, err := r.URL(tc.name, tc.params...)
+		if err != nil || u != tc.url {
+			t.Fatalf("URL(%s, %v): expected %s, got %s %v", tc.name, tc.params, tc.url, u, err)
+		}
+	}
+
+	for _, params := range [][]string{{"user.show"}, {"user.show", "id", "abc"}, {"user.show", "id"}, {"missing"},
+		{"post", "year", "24", "slug", "a"}, {"post", "year", "2024", "slug", "Bad_Slug"}} {
+		if _, err := r.URL(params[0], params[1:]...); err == nil {
+			t.Fatalf("URL(%v) should fail", params)
+		}
+	}
+
+	//生成url使用注册时编译的约束， 不再读取约束表
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			RegisterConstraint(fmt.Sprintf("named%d", i), isInt)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := r.URL("user.show", "id", "42"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("reusing a route name should panic")
+		}
+	}()
+	r.GET("/other", func(c *Context) {}).Name("user.show")
+}
+
+func TestURLForTemplate(t *testing.T) {
+	r := New()
+	r.GET("/user/:id", func(c *Context) {
+		c.HTML(http.StatusOK, "user.tmpl", 42)
+	}).Name("user.show")
+
+	dir, err := ioutil.TempDir("", "gee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpl := `<a href="{{urlFor "user.show" "id" .}}">me</a>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "user.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.LoadHTMLGlob(filepath.Join(dir, "*"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/user/42", nil))
+	if w.Body.String() != `<a href="/user/42">me</a>` {
+		t.Fatalf("urlFor should be available in templates, got %q", w.Body.String())
+	}
+}
+
+func hello(c *Context) {
+	c.String(http.StatusOK, "hello")
+}
+
+func TestRoutes(t *testing.T) {
+	r := New()
+	r.Use(Logger())
+	v1 := r.Group("/v1")
+	v1.Use(Recovery())
+	v1.GET("/hello/:name", hello).Name("hello")
+	v1.POST("/hello", Logger(), hello)
+	r.GET("/list/:page?", hello)
+
+	routes := r.Routes()
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+	expected := []RouteInfo{
+		{Method: "GET", Path: "/list/:page?", Handler: "gee.hello", Middlewares: []string{"gee.Logger.func1"}},
+		{Method: "POST", Path: "/v1/hello", Handler: "gee.hello", Middlewares: []string{"gee.Logger.func1", "gee.Recovery.func1", "gee.Logger.func1"}},
+		{Method: "GET", Path: "/v1/hello/:name", Name: "hello", Handler: "gee.hello", Middlewares: []string{"gee.Logger.func1", "gee.Recovery.func1"}},
+	}
+	for i, want := range expected {
+		got := routes[i]
+		got.HandlerFunc = nil
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("route %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+}
+
+func TestRouteMetadata(t *testing.T) {
+	r := New()
+	var seen []interface{}
+	r.Use(func(c *Context) {
+		scopes, ok := c.RouteMeta("scopes")
+		seen = append(seen, c.FullPath(), c.RouteName(), scopes, ok)
+		c.Next()
+	})
+	r.GET("/orders/:id", func(c *Context) {}).
+		Name("order.show").
+		Meta("owner", "payments").
+		Meta("scopes", []string{"orders:read"})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/42", nil))
+	expected := []interface{}{"/orders/:id", "order.show", []string{"orders:read"}, true}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("middleware should see route metadata, got %v", seen)
+	}
+
+	seen = nil
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nothing", nil))
+	if !reflect.DeepEqual(seen, []interface{}{"", "", nil, false}) {
+		t.Fatalf("unmatched requests have no route metadata, got %v", seen)
+	}
+
+	if owner := r.Routes()[0].Meta["owner"]; owner != "payments" {
+		t.Fatalf("Routes should expose metadata, got %v", owner)
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	r := New()
+	var order []string
+	r.Use(func(c *Context) {
+		order = append(order, "global")
+		c.Next()
+	})
+	r.GET("/", func(c *Context) { c.String(http.StatusOK, "default") })
+	r.GET("/healthz", func(c *Context) { c.String(http.StatusOK, "ok") })
+
+	api := r.Host("api.example.com")
+	api.Use(func(c *Context) {
+		order = append(order, "api")
+		c.Next()
+	})
+	api.GET("/", func(c *Context) { c.String(http.StatusOK, "api") })
+
+	tenant := r.Host(":tenant.example.com")
+	tenant.GET("/users/:id", func(c *Context) {
+		c.String(http.StatusOK, "%s %s", c.Param("tenant"), c.Param("id"))
+	})
+	tenant.NoRoute(func(c *Context) { c.String(http.StatusNotFound, "tenant 404") })
+
+	r.Host("*.admin.example.com").GET("/", func(c *Context) { c.String(http.StatusOK, "admin") })
+
+	cases := []struct {
+		host, path string
+		code       int
+		body       string
+		order      string
+	}{
+		{"api.example.com", "/", http.StatusOK, "api", "global,api"},
+		{"API.example.com:8080", "/", http.StatusOK, "api", "global,api"},
+		{"acme.example.com", "/users/42", http.StatusOK, "acme 42", "global"},
+		{"acme.example.com", "/missing", http.StatusNotFound, "tenant 404", "global"},
+		{"eu.admin.example.com", "/", http.StatusOK, "admin", "global"},
+		{"a.b.admin.example.com", "/", http.StatusOK, "default", "global"},
+		{"api.example.com", "/healthz", http.StatusOK, "ok", "global"},
+		{"other.org", "/", http.StatusOK, "default", "global"},
+	}
+	for _, tc := range cases {
+		order = nil
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Host = tc.host
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code || w.Body.String() != tc.body || strings.Join(order, ",") != tc.order {
+			t.Fatalf("%s%s: expected %d %q %s, got %d %q %v", tc.host, tc.path, tc.code, tc.body, tc.order, w.Code, w.Body.String(), order)
+		}
+	}
+
+	if r.Host("API.example.com") != api {
+		t.Fatal("Host should return the same group for the same pattern")
+	}
+	routes := r.Routes()
+	if len(routes) != 5 || routes[0].Host != "" || routes[2].Host != "*.admin.example.com" {
+		t.Fatalf("Routes should list host routes, got %+v", routes)
+	}
+}
+
+func TestRouteConditions(t *testing.T) {
+	r := New()
+	text := func(s string) HandlerFunc {
+		return func(c *Context) { c.String(http.StatusOK, s) }
+	}
+	r.With(MatchContentType("application/json")).POST("/upload", text("json"))
+	r.With(MatchContentType("multipart/form-data")).POST("/upload", text("multipart"))
+	v2 := r.Group("/api").With(MatchHeader("X-API-Version", "2"))
+	v2.GET("/items", text("v2"))
+	v2.With(MatchQuery("format", "csv")).GET("/items", text("v2 csv"))
+	r.GET("/api/items", text("v1"))
+	r.With(MatchAccept("application/json")).GET("/report", text("report"))
+	r.With(MatchScheme("https")).GET("/secure", text("secure"))
+
+	cases := []struct {
+		method, path string
+		header       map[string]string
+		code         int
+		body         string
+	}{
+		{"POST", "/upload", map[string]string{"Content-Type": "application/json; charset=utf-8"}, http.StatusOK, "json"},
+		{"POST", "/upload", map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, http.StatusOK, "multipart"},
+		{"POST", "/upload", map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType, ""},
+		{"GET", "/api/items", map[string]string{"X-API-Version": "2"}, http.StatusOK, "v2"},
+		{"GET", "/api/items?format=csv", map[string]string{"X-API-Version": "2"}, http.StatusOK, "v2 csv"},
+		{"GET", "/api/items", nil, http.StatusOK, "v1"},
+		{"GET", "/report", map[string]string{"Accept": "text/html, application/*;q=0.9"}, http.StatusOK, "report"},
+		{"GET", "/report", map[string]string{"Accept": "text/html"}, http.StatusNotAcceptable, ""},
+		{"GET", "/secure", nil, http.StatusNotFound, ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code || tc.body != "" && w.Body.String() != tc.body {
+			t.Fatalf("%s %s %v: expected %d %q, got %d %q", tc.method, tc.path, tc.header, tc.code, tc.body, w.Code, w.Body.String())
+		}
+	}
+
+	routes := r.Routes()
+	if len(routes) != 7 || !reflect.DeepEqual(routes[0].Conditions, []string{"header:X-Api-Version=2", "query:format=csv"}) {
+		t.Fatalf("Routes should list conditions, got %+v", routes)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("same path and conditions should panic")
+		}
+	}()
+	r.With(MatchContentType("application/json")).POST("/upload", text("again"))
+}
+
+func TestMount(t *testing.T) {
+	r := New()
+	var statuses []int
+	r.Use(func(c *Context) {
+		c.Next()
+		statuses = append(statuses, c.Writer.Status())
+	})
+
+	legacy := http.NewServeMux()
+	legacy.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	v1 := r.Group("/v1")
+	v1.Use(func(c *Context) {
+		c.SetHeader("X-Group", "v1")
+		c.Next()
+	})
+	v1.Mount("/legacy", legacy)
+
+	sub := New()
+	sub.GET("/", func(c *Context) { c.String(http.StatusOK, "sub root") })
+	sub.POST("/users/:id", func(c *Context) { c.String(http.StatusCreated, "user %s", c.Param("id")) })
+	r.Mount("/team/", sub)
+	r.GET("/ping", WrapF(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+
+	cases := []struct {
+		method, path string
+		code         int
+		body, xpath  string
+	}{
+		{"GET", "/v1/legacy", http.StatusAccepted, "", "/"},
+		{"DELETE", "/v1/legacy/a/b", http.StatusAccepted, "", "/a/b"},
+		{"PROPFIND", "/v1/legacy/dav/x", http.StatusAccepted, "", "/dav/x"},
+		{"PROPFIND", "/v1/legacy", http.StatusAccepted, "", "/"},
+		{"PROPFIND", "/ping", http.StatusNotFound, "", ""},
+		{"GET", "/v1/legacyx", http.StatusNotFound, "", ""},
+		{"GET", "/team", http.StatusOK, "sub root", ""},
+		{"POST", "/team/users/7", http.StatusCreated, "user 7", ""},
+		{"GET", "/ping", http.StatusOK, "pong", ""},
+	}
+	for _, tc := range cases {
+		statuses = nil
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.code || tc.body != "" && w.Body.String() != tc.body || w.Header().Get("X-Path") != tc.xpath {
+			t.Fatalf("%s %s: expected %d %q %q, got %d %q %q", tc.method, tc.path, tc.code, tc.body, tc.xpath, w.Code, w.Body.String(), w.Header().Get("X-Path"))
+		}
+		if tc.xpath != "" && w.Header().Get("X-Group") != "v1" {
+			t.Fatalf("%s: mounted handler should run the group middleware", tc.path)
+		}
+		if len(statuses) != 1 || tc.xpath != "" && statuses[0] != tc.code {
+			t.Fatalf("%s: middleware should see status %d, got %v", tc.path, tc.code, statuses)
+		}
+	}
+
+	//标准请求方法以各自的路由树为准， 删除后不再交给挂载的handler
+	r.RemoveRoute("DELETE", "/v1/legacy/*path?")
+	for method, code := range map[string]int{"DELETE": http.StatusNotFound, "PROPFIND": http.StatusAccepted, "GET": http.StatusAccepted} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/v1/legacy/a", nil))
+		if w.Code != code {
+			t.Fatalf("%s after removing DELETE: expected %d, got %d", method, code, w.Code)
+		}
+	}
+}
+
+func TestRemoveRoute(t *testing.T) {
+	r := New()
+	r.GET("/users/:id", func(c *Context) { c.String(http.StatusOK, "user") }).Name("user")
+	r.GET("/users/:id/posts", func(c *Context) { c.String(http.StatusOK, "posts") })
+	r.Any("/ping", func(c *Context) { c.String(http.StatusOK, "pong") }).Name("ping")
+
+	if !r.RemoveRoute("GET", "/users/:id") || r.RemoveRoute("GET", "/users/:id") || r.RemoveRoute("PURGE", "/ping") {
+		t.Fatal("RemoveRoute should report whether a route was removed")
+	}
+	for path, code := range map[string]int{"/users/1": http.StatusNotFound, "/users/1/posts": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Fatalf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+	if _, err := r.URL("user"); err == nil {
+		t.Fatal("name of a removed route should be released")
+	}
+
+	r.RemoveRoute("GET", "/ping")
+	if _, err := r.URL("ping"); err != nil {
+		t.Fatal("name should stay while the route is registered for other methods")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/ping", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("removing GET should keep the other methods, got %d", w.Code)
+	}
+
+	//运行时并发添加和删除路由
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pattern := fmt.Sprintf("/plugin%d/%d", i, j)
+				r.GET(pattern, func(c *Context) { c.String(http.StatusOK, "plugin") })
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("GET", pattern, nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: expected 200, got %d", pattern, w.Code)
+				}
+				if j%2 == 0 {
+					r.RemoveRoute("GET", pattern)
+				}
+			}
+		}(i)
+	}
+	//路由发布后修改名字和元数据， 同时有请求在读取
+	live := r.GET("/live", func(c *Context) {
+		c.RouteMeta("n")
+		c.String(http.StatusOK, c.RouteName())
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/live", nil))
+		}
+	}()
+	for j := 0; j < 100; j++ {
+		live.Meta("n", j).Name(fmt.Sprintf("live%d", j%2))
+	}
+	wg.Wait()
+	if len(r.Routes()) != 1+8+100+1 {
+		t.Fatalf("expected 110 routes, got %d", len(r.Routes()))
+	}
+	if attrs := live.loadAttrs(); attrs.meta["n"] != 99 || attrs.name != "live1" {
+		t.Fatalf("Name and Meta should keep the last values, got %+v", attrs)
+	}
+
+	//Any和Mount中任意一个方法冲突时， 其他方法也不注册
+	r.POST("/x", func(c *Context) {})
+	r.POST("/dav/*path", func(c *Context) {})
+	for _, register := range []func(){
+		func() { r.Any("/x", func(c *Context) {}) },
+		func() { r.Mount("/dav", http.NotFoundHandler()) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("conflicting registration should panic")
+				}
+			}()
+			register()
+		}()
+	}
+	for _, path := range []string{"/x", "/dav/a"} {
+		for _, method := range []string{"GET", "PROPFIND"} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("%s %s: failed registration should leave no route behind, got %d", method, path, w.Code)
+			}
+		}
+	}
+
+	//删除Host和组下的路由， 同时有请求在匹配域名
+	api := r.Host("api.example.com")
+	api.Group("/v1").GET("/users", func(c *Context) { c.String(http.StatusOK, "api") }).Name("api.users")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			r.Host(fmt.Sprintf("t%d.example.com", j)).GET("/", func(c *Context) {})
+		}
+	}()
+	for j := 0; j < 50; j++ {
+		req := httptest.NewRequest("GET", "/v1/users", nil)
+		req.Host = "api.example.com"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	wg.Wait()
+	if r.RemoveRoute("GET", "/v1/users") || !api.Group("/v1").RemoveRoute("GET", "/users") {
+		t.Fatal("RemoveRoute should only remove routes of the group's host")
+	}
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	req.Host = "api.example.com"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("removed host route should return 404, got %d", w.Code)
+	}
+	if _, err := r.URL("api.users"); err == nil {
+		t.Fatal("name of a removed host route should be released")
+	}
+
+	//Mount的路由在所有请求方法下删除后， 其他请求方法也不再交给挂载的handler
+	r.Mount("/files", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/files/x", nil))
+		return w.Code
+	}
+	for i, method := range anyMethods {
+		if !r.RemoveRoute(method, "/files/*path?") {
+			t.Fatalf("%s: mounted route should be removed", method)
+		}
+		if i < len(anyMethods)-1 && serve("PROPFIND") != http.StatusOK {
+			t.Fatal("mount should keep serving other methods while registered under any method")
+		}
+	}
+	if code := serve("GET"); code != http.StatusNotFound {
+		t.Fatalf("GET on a removed mount should return 404, got %d", code)
+	}
+	if code := serve("PROPFIND"); code != http.StatusNotFound {
+		t.Fatalf("PROPFIND on a removed mount should return 404, got %d", code)
+	}
+}
+
+func TestUseRawPath(t *testing.T) {
+	r := New()
+	r.GET("/files/:key", func(c *Context) { c.String(http.StatusOK, "key=%s", c.Param("key")) })
+	r.GET("/files/:key/:name", func(c *Context) { c.String(http.StatusOK, "dir=%s name=%s", c.Param("key"), c.Param("name")) })
+	r.GET("/objects/*key", func(c *Context) { c.String(http.StatusOK, "key=%s", c.Param("key")) })
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+	if body := get("/files/a%2Fb"); body != "dir=a name=b" {
+		t.Fatalf("decoded path should split %%2F by default, got %q", body)
+	}
+
+	r.UseRawPath = true
+	cases := map[string]string{
+		"/files/a%2Fb":             "key=a/b",
+		"/files/a/b":               "dir=a name=b",
+		"/files/a%2Fb/c%20d":       "dir=a/b name=c d",
+		"/objects/x%2Fy/z%3Fw.txt": "key=x/y/z?w.txt",
+	}
+	for path, expected := range cases {
+		if body := get(path); body != expected {
+			t.Fatalf("%s: expected %q, got %q", path, expected, body)
+		}
+	}
+
+	r.UnescapePathValues = false
+	if body := get("/files/a%2Fb"); body != "key=a%2Fb" {
+		t.Fatalf("params should stay escaped without UnescapePathValues, got %q", body)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	r := New()
+	r.GET("/products/:name", func(c *Context) { c.String(http.StatusOK, "product %s", c.Param("name")) })
+	r.GET("/about/", func(c *Context) { c.String(http.StatusOK, "about") })
+	r.GET("/static/*filepath", func(c *Context) { c.String(http.StatusOK, "file %s", c.Param("filepath")) })
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := serve("/Products/Shoes"); w.Code != http.StatusNotFound {
+		t.Fatalf("routing should be case sensitive by default, got %d", w.Code)
+	}
+
+	r.CaseInsensitive = true
+	cases := map[string]string{
+		"/Products/Shoes":      "product Shoes",
+		"/PRODUCTS/Red-Shoes":  "product Red-Shoes",
+		"/About/":              "about",
+		"/STATIC/CSS/Main.css": "file CSS/Main.css",
+		"/products/lower-case": "product lower-case",
+	}
+	for path, expected := range cases {
+		if w := serve(path); w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatalf("%s: expected %q, got %d %q", path, expected, w.Code, w.Body.String())
+		}
+	}
+
+	r.RedirectCaseInsensitive = true
+	r.RedirectTrailingSlash = true
+	redirects := map[string]string{
+		"/Products/Shoes?size=9": "/products/Shoes?size=9",
+		"/ABOUT":                 "/about/",
+	}
+	for path, location := range redirects {
+		if w := serve(path); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+			t.Fatalf("%s: expected redirect to %s, got %d %q", path, location, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if w := serve("/products/Shoes"); w.Code != http.StatusOK {
+		t.Fatalf("canonical casing should not redirect, got %d", w.Code)
+	}
+}
+
+func TestRoutePolicies(t *testing.T) {
+	r := New()
+	r.Use(Recovery())
+	echo := func(c *Context) {
+		body, err := ioutil.ReadAll(c.Req.Body)
+		if err != nil {
+			c.String(http.StatusRequestEntityTooLarge, "read: %v", err)
+			return
+		}
+		c.String(http.StatusOK, "%d bytes", len(body))
+	}
+	r.With(WithBodyLimit(8)).POST("/upload", echo)
+	r.POST("/echo", echo)
+
+	renderer := func(c *Context, code int, err error) {
+		c.Json(code, H{"error": err.Error()})
+	}
+	slow := r.With(WithTimeout(20*time.Millisecond), WithErrorRenderer(renderer))
+	slow.GET("/report/:delay", func(c *Context) {
+		delay, _ := time.ParseDuration(c.Param("delay"))
+		select {
+		case <-time.After(delay):
+		case <-c.Req.Context().Done():
+			return
+		}
+		c.SetHeader("X-Report", "done")
+		c.String(http.StatusCreated, "report %s", c.Param("delay"))
+	})
+	slow.GET("/panic", func(c *Context) { panic("boom") })
+
+	cases := []struct {
+		method, path, body string
+		code               int
+		response           string
+	}{
+		{"POST", "/upload", "12345678", http.StatusOK, "8 bytes"},
+		{"POST", "/upload", "123456789", http.StatusRequestEntityTooLarge, "413 REQUEST ENTITY TOO LARGE: /upload \n"},
+		{"POST", "/echo", "123456789", http.StatusOK, "9 bytes"},
+		{"GET", "/report/1ms", "", http.StatusCreated, "report 1ms"},
+		{"GET", "/report/1s", "", http.StatusServiceUnavailable, "{\"error\":\"gee: handler timeout\"}\n"},
+		{"GET", "/panic", "", http.StatusInternalServerError, "{\"message\":\"Internal Server Error\"}\n"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code != tc.code || w.Body.String() != tc.response {
+			t.Fatalf("%s %s: expected %d %q, got %d %q", tc.method, tc.path, tc.code, tc.response, w.Code, w.Body.String())
+		}
+		if tc.code == http.StatusCreated && w.Header().Get("X-Report") != "done" {
+			t.Fatal("headers set inside a timeout route should be sent")
+		}
+	}
+
+	//长度未知的请求体在读取时限制
+	req := httptest.NewRequest("POST", "/upload", ioutil.NopCloser(strings.NewReader("123456789")))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.HasPrefix(w.Body.String(), "read: ") {
+		t.Fatalf("body without Content-Length should be limited while reading, got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, info := range r.Routes() {
+		switch info.Path {
+		case "/upload":
+			if info.BodyLimit != 8 || info.Timeout != 0 {
+				t.Fatalf("unexpected policies for /upload: %+v", info)
+			}
+		case "/report/:delay":
+			if info.Timeout != 20*time.Millisecond || info.BodyLimit != 0 || info.Handler == "" {
+				t.Fatalf("unexpected policies for /report/:delay: %+v", info)
+			}
+		}
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	r := New()
+	type record struct {
+		status, size int
+		written      bool
+	}
+	var got record
+	r.Use(func(c *Context) {
+		c.Next()
+		got = record{c.Writer.Status(), c.Writer.Size(), c.Writer.Written()}
+	})
+	r.GET("/direct", func(c *Context) {
+		c.Writer.WriteHeader(http.StatusAccepted)
+		c.Writer.Write([]byte("direct"))
+	})
+	r.GET("/status", func(c *Context) {
+		c.Status(http.StatusCreated)
+		c.Status(http.StatusNoContent) //响应头发送前可以修改
+	})
+	r.GET("/stream", func(c *Context) {
+		c.Writer.Write([]byte("chunk"))
+		c.Writer.Flush()
+		c.Status(http.StatusTeapot) //响应头已经发送， 不再生效
+		if _, _, err := c.Writer.Hijack(); err == nil {
+			t.Error("Hijack should fail when the underlying writer doesn't support it")
+		}
+	})
+	r.GET("/page", func(c *Context) { c.HTML(http.StatusOK, "page", 42) })
+	r.htmlTemplates = template.Must(template.New("page").Parse("before {{.Missing}}"))
+
+	cases := []struct {
+		path string
+		code int
+		body string
+		rec  record
+	}{
+		{"/direct", http.StatusAccepted, "direct", record{http.StatusAccepted, 6, true}},
+		{"/status", http.StatusNoContent, "", record{http.StatusNoContent, -1, false}},
+		{"/stream", http.StatusOK, "chunk", record{http.StatusOK, 5, true}},
+		{"/page", http.StatusInternalServerError, "", record{http.StatusInternalServerError, -1, true}},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code || tc.body != "" && w.Body.String() != tc.body {
+			t.Fatalf("%s: expected %d %q, got %d %q", tc.path, tc.code, tc.body, w.Code, w.Body.String())
+		}
+		if tc.rec.size >= 0 && got != tc.rec || got.status != tc.rec.status || got.written != tc.rec.written {
+			t.Fatalf("%s: expected writer state %+v, got %+v", tc.path, tc.rec, got)
+		}
+		if tc.path == "/stream" && !w.Flushed {
+			t.Fatal("Flush should reach the underlying writer")
+		}
+		if tc.path == "/page" && strings.Contains(w.Body.String(), "before") {
+			t.Fatalf("a failed render should not send partial output, got %q", w.Body.String())
+		}
+	}
+}
+
+func TestContextKeysAndAbort(t *testing.T) {
+	r := New()
+	var aborted bool
+	var errs []error
+	r.Use(func(c *Context) {
+		c.Next()
+		aborted = c.IsAborted()
+		errs = c.Errors
+	})
+	auth := func(c *Context) {
+		switch c.Req.Header.Get("Authorization") {
+		case "":
+			c.AbortWithStatus(http.StatusUnauthorized)
+		case "bad":
+			c.AbortWithError(http.StatusForbidden, errors.New("bad token"))
+		case "json":
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, H{"plan": "free"})
+		default:
+			c.Set("user", "geektutu")
+			c.Set("roles", []string{"admin"})
+			c.Set("since", 3*time.Second)
+			c.Next()
+		}
+	}
+	profile := func(c *Context) {
+		c.String(http.StatusOK, "%s %v %v %q %d", c.MustGet("user"), c.GetStringSlice("roles"), c.GetDuration("since"), c.GetString("roles"), c.GetInt("missing"))
+	}
+	r.GET("/profile", auth, profile)
+	r.With(WithTimeout(time.Second)).GET("/slow", auth, func(c *Context) {
+		c.Set("handled", true)
+		c.Abort()
+		c.String(http.StatusOK, c.GetString("user"))
+	})
+
+	cases := []struct {
+		path, token string
+		code        int
+		body        string
+		aborted     bool
+	}{
+		{"/profile", "", http.StatusUnauthorized, "", true},
+		{"/profile", "bad", http.StatusForbidden, "", true},
+		{"/profile", "json", http.StatusPaymentRequired, "{\"plan\":\"free\"}\n", true},
+		{"/profile", "ok", http.StatusOK, `geektutu [admin] 3s "" 0`, false},
+		{"/slow", "ok", http.StatusOK, "geektutu", true},
+	}
+	for _, tc := range cases {
+		errs = nil
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", tc.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code || w.Body.String() != tc.body || aborted != tc.aborted {
+			t.Fatalf("%s %q: expected %d %q aborted=%t, got %d %q aborted=%t", tc.path, tc.token, tc.code, tc.body, tc.aborted, w.Code, w.Body.String(), aborted)
+		}
+		if tc.token == "bad" && (len(errs) != 1 || errs[0].Error() != "bad token") {
+			t.Fatalf("AbortWithError should record the error, got %v", errs)
+		}
+	}
+
+	c := &Context{}
+	c.Set("n", 1)
+	if c.GetInt("n") != 1 || c.GetString("n") != "" || c.GetBool("n") {
+		t.Fatal("typed getters should return the zero value for other types")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustGet should panic for a missing key")
+		}
+	}()
+	c.MustGet("missing")
+}
@@ -0,0 +1,100 @@
+package gee
+
+import (
+	"fmt"
+	"strings"
+)
+
+//按域名划分的路由， 每个域名有自己的路由树、中间件和NoRoute
+type host struct {
+	pattern string
+	labels  []string //按 . 分割的域名， :name 匹配一段并作为参数， * 匹配一段
+	wild    bool     //是否含有动态段
+	router  *router
+	group   *RouterGroup
+}
+
+//返回域名对应的路由组， 如 api.example.com 、 :tenant.example.com 和 *.example.com
+//域名中的参数可以通过 c.Param 获取； 请求的域名不匹配任何Host时使用默认域名的路由
+//可以在服务运行时调用， 域名列表复制后整体替换
+func (engine *Engine) Host(pattern string) *RouterGroup {
+	pattern = strings.ToLower(pattern)
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	hosts := engine.loadHosts()
+	for _, h := range hosts {
+		if h.pattern == pattern {
+			return h.group
+		}
+	}
+
+	h := &host{pattern: pattern, labels: strings.Split(pattern, "."), router: newRouter()}
+	for _, label := range h.labels {
+		if label == "" || label == ":" {
+			panic(fmt.Sprintf("gee: invalid host pattern %q", pattern))
+		}
+		if label[0] == ':' || label == "*" {
+			h.wild = true
+		}
+	}
+	h.group = &RouterGroup{parent: engine.RouterGroup, engine: engine, host: h}
+	engine.groups = append(engine.groups, h.group)
+
+	//不带通配的域名优先匹配
+	hosts = append(hosts[:len(hosts):len(hosts)], h)
+	for i := len(hosts) - 1; i > 0 && !h.wild && hosts[i-1].wild; i-- {
+		hosts[i], hosts[i-1] = hosts[i-1], hosts[i]
+	}
+	engine.hosts.Store(hosts)
+	return h.group
+}
+
+//当前Host注册的域名， 不带通配的排在前面
+func (engine *Engine) loadHosts() []*host {
+	hosts, _ := engine.hosts.Load().([]*host)
+	return hosts
+}
+
+//查找请求域名对应的Host， 域名参数追加到params中， 没有匹配时返回nil
+func (engine *Engine) matchHost(hostname string, params *Params) *host {
+	hosts := engine.loadHosts()
+	if len(hosts) == 0 || hostname == "" {
+		return nil
+	}
+	if i := strings.LastIndexByte(hostname, ':'); i > strings.LastIndexByte(hostname, ']') { //去掉端口
+		hostname = hostname[:i]
+	}
+	for _, h := range hosts {
+		if h.match(hostname, params) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (h *host) match(hostname string, params *Params) bool {
+	start := len(*params)
+	for i, label := range h.labels {
+		end := strings.IndexByte(hostname, '.')
+		if end < 0 {
+			end = len(hostname)
+		}
+		if end == 0 || (end == len(hostname)) != (i == len(h.labels)-1) {
+			*params = (*params)[:start]
+			return false
+		}
+		value := hostname[:end]
+		switch {
+		case label[0] == ':':
+			*params = append(*params, Param{Key: label[1:], Value: value})
+		case label == "*":
+		case !strings.EqualFold(label, value):
+			*params = (*params)[:start]
+			return false
+		}
+		if end < len(hostname) {
+			hostname = hostname[end+1:]
+		}
+	}
+	return true
+}
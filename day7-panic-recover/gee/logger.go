@@ -12,6 +12,10 @@ func Logger() HandlerFunc {
 		//fmt.Println("hsz3")
 		c.Next()
 		//fmt.Println("hsz33")
-		log.Printf("[%d] %s in %v", c.StatusCode, c.Req.RequestURI, time.Since(t))
+		if len(c.Errors) > 0 {
+			log.Printf("[%d] %s in %v, errors: %v", c.Writer.Status(), c.Req.RequestURI, time.Since(t), c.Errors)
+			return
+		}
+		log.Printf("[%d] %s in %v", c.Writer.Status(), c.Req.RequestURI, time.Since(t))
 	}
 }
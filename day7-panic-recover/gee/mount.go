@@ -0,0 +1,63 @@
+package gee
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+//把http.Handler转换为HandlerFunc， 如 WrapH(http.FileServer(...))
+func WrapH(h http.Handler) HandlerFunc {
+	return func(c *Context) {
+		h.ServeHTTP(c.Writer, c.Req)
+	}
+}
+
+//把http.HandlerFunc转换为HandlerFunc
+func WrapF(f http.HandlerFunc) HandlerFunc {
+	return WrapH(f)
+}
+
+//在组下的prefix挂载http.Handler， 如旧的net/http handler或另一个Engine
+//prefix下所有请求方法和路径都交给handler处理， 转发前去掉组前缀和prefix， handler看到的路径以 / 开头
+//标准请求方法通过Any注册， 其他方法（如WebDAV的PROPFIND）在没有匹配的路由时交给handler
+//请求会先经过该组及上层组的中间件
+func (group *RouterGroup) Mount(prefix string, handler http.Handler) *Route {
+	if handler == nil {
+		panic("gee: mount handler must not be nil")
+	}
+	full := path.Join("/", group.prefix, prefix)
+	strip := strings.TrimRight(full, "/")
+	wrapped := WrapH(stripPrefix(strip, handler))
+	//可选的*通配同时匹配 /prefix 和 /prefix/... ， 且不会触发结尾斜杠的重定向
+	route := group.newRoute("ANY", path.Join(prefix, "/*path?"), []HandlerFunc{wrapped})
+	group.host.router.insertMount(route, anyMethods...)
+	return route
+}
+
+//去掉路径前缀后调用handler， 路径等于前缀时变为 /
+func stripPrefix(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := strings.TrimPrefix(req.URL.Path, prefix)
+		if p == "" {
+			p = "/"
+		}
+		r := new(http.Request)
+		*r = *req
+		r.URL = new(url.URL)
+		*r.URL = *req.URL
+		r.URL.Path = p
+		r.URL.RawPath = ""
+		if strings.HasPrefix(req.URL.RawPath, prefix) { //前缀被转义时RawPath无法对应， 由Path重新生成
+			r.URL.RawPath = req.URL.RawPath[len(prefix):]
+			if r.URL.RawPath == "" {
+				r.URL.RawPath = "/"
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
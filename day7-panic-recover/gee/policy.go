@@ -0,0 +1,176 @@
+package gee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//请求体超过路由的WithBodyLimit
+	ErrBodyTooLarge = errors.New("gee: request body too large")
+	//handler没有在路由的WithTimeout内完成
+	ErrTimeout = errors.New("gee: handler timeout")
+)
+
+//渲染路由策略产生的错误， 如413和503
+type ErrorRenderer func(c *Context, code int, err error)
+
+//限制请求体的大小， 超过时返回413
+//Content-Length已知时直接拒绝， 否则handler读取超出的部分时返回错误
+func WithBodyLimit(limit int64) RouteOption {
+	return func(route *Route) {
+		route.bodyLimit = limit
+	}
+}
+
+//限制handler的执行时间， 超时返回503， 请求的context同时被取消
+//handler在单独的goroutine中运行， 响应先写入缓冲， 完成后再发送
+func WithTimeout(timeout time.Duration) RouteOption {
+	return func(route *Route) {
+		route.timeout = timeout
+	}
+}
+
+//自定义WithBodyLimit和WithTimeout的错误响应
+func WithErrorRenderer(renderer ErrorRenderer) RouteOption {
+	return func(route *Route) {
+		route.errorRenderer = renderer
+	}
+}
+
+func defaultErrorRenderer(c *Context, code int, err error) {
+	c.String(code, "%d %s: %s \n", code, strings.ToUpper(http.StatusText(code)), c.Path)
+}
+
+func (route *Route) renderError(c *Context, code int, err error) {
+	if route.errorRenderer != nil {
+		route.errorRenderer(c, code, err)
+	} else {
+		defaultErrorRenderer(c, code, err)
+	}
+}
+
+//把路由策略插入到handler链中路由自己的handler之前， start为其位置， 之前为组中间件
+func (route *Route) applyPolicies(start int) {
+	policies := make([]HandlerFunc, 0, 2)
+	if route.bodyLimit > 0 {
+		policies = append(policies, route.limitBody)
+	}
+	if route.timeout > 0 {
+		policies = append(policies, route.runWithTimeout)
+	}
+	if len(policies) == 0 {
+		return
+	}
+	handlers := make([]HandlerFunc, 0, len(route.handlers)+len(policies))
+	handlers = append(handlers, route.handlers[:start]...)
+	handlers = append(handlers, policies...)
+	route.handlers = append(handlers, route.handlers[start:]...)
+}
+
+func (route *Route) limitBody(c *Context) {
+	if c.Req.ContentLength > route.bodyLimit {
+		c.Abort()
+		route.renderError(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+		return
+	}
+	if c.Req.Body != nil {
+		c.Req.Body = http.MaxBytesReader(c.Writer, c.Req.Body, route.bodyLimit)
+	}
+	c.Next()
+}
+
+//在新的goroutine中执行之后的handler， 超时后丢弃其响应
+func (route *Route) runWithTimeout(c *Context) {
+	ctx, cancel := context.WithTimeout(c.Req.Context(), route.timeout)
+	defer cancel()
+
+	tw := &timeoutWriter{header: make(http.Header)}
+	tc := c.fork(tw, c.Req.WithContext(ctx))
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				panicked <- err
+				return
+			}
+			close(done)
+		}()
+		tc.Next()
+		tc.Writer.WriteHeaderNow()
+	}()
+
+	c.index = len(c.handlers) //之后的handler只在goroutine中执行
+	select {
+	case err := <-panicked:
+		panic(err) //交给外层的Recovery处理
+	case <-done:
+		//handler链中的Abort、键值对和错误对外层中间件可见
+		if tc.IsAborted() {
+			c.Abort()
+		}
+		c.Errors = tc.Errors
+		for key, value := range tc.Keys {
+			c.Set(key, value)
+		}
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		header := c.Writer.Header()
+		for key, values := range tw.header {
+			header[key] = values
+		}
+		if tw.code != 0 {
+			c.Status(tw.code)
+		}
+		c.Writer.Write(tw.buf.Bytes())
+	case <-ctx.Done():
+		tw.mu.Lock()
+		tw.timedOut = true
+		tw.mu.Unlock()
+		route.renderError(c, http.StatusServiceUnavailable, ErrTimeout)
+	}
+}
+
+//缓存超时路由的响应， 超时后的写入返回http.ErrHandlerTimeout
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.buf.Write(data)
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.code != 0 {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("gee: invalid WriteHeader code %v", code))
+	}
+	w.code = code
+}
@@ -0,0 +1,108 @@
+package gee
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+const noWritten = -1
+
+//包装http.ResponseWriter， 记录状态码、响应体大小和响应头是否已发送
+//WriteHeader只记录状态码， 第一次写入响应体或请求结束时才发送响应头， 因此可以在handler中多次修改
+type ResponseWriter interface {
+	http.ResponseWriter
+	http.Hijacker
+	http.Flusher
+	http.CloseNotifier
+
+	//返回响应的状态码， 没有设置时为200
+	Status() int
+	//返回已写入的响应体字节数， 响应头还没有发送时为-1
+	Size() int
+	//响应头是否已经发送
+	Written() bool
+	//立即发送响应头
+	WriteHeaderNow()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	size   int
+	status int
+}
+
+var _ ResponseWriter = &responseWriter{}
+
+func (w *responseWriter) reset(writer http.ResponseWriter) {
+	w.ResponseWriter = writer
+	w.size = noWritten
+	w.status = http.StatusOK
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if code <= 0 || w.status == code {
+		return
+	}
+	if w.Written() { //响应头已经发送， 状态码无法修改
+		log.Printf("[WARNING] Headers were already written. Wanted to override status code %d with %d", w.status, code)
+		return
+	}
+	w.status = code
+}
+
+func (w *responseWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+func (w *responseWriter) Size() int {
+	return w.size
+}
+
+func (w *responseWriter) Written() bool {
+	return w.size != noWritten
+}
+
+//接管连接， 如websocket， 之后不能再通过ResponseWriter写入
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("gee: the ResponseWriter doesn't support hijacking")
+	}
+	if w.size < 0 {
+		w.size = 0
+	}
+	return hijacker.Hijack()
+}
+
+//发送缓冲的数据， 用于流式响应
+func (w *responseWriter) Flush() {
+	w.WriteHeaderNow()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//客户端断开连接时收到通知， 底层不支持时返回的channel不会收到数据
+func (w *responseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
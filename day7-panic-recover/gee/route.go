@@ -0,0 +1,273 @@
+package gee
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//注册路由时返回的路由信息， 用于给路由命名等
+type Route struct {
+	pattern    string              //注册时的完整路由， 包含组前缀
+	handlers   []HandlerFunc       //完整的handler链
+	attrs      atomic.Value        //当前的*routeAttrs， 路由发布后仍可通过Name和Meta修改
+	conditions []condition         //匹配条件， 如请求头和Content-Type
+	checks     []func(string) bool //各动态片段的约束函数， 注册时编译
+
+	bodyLimit     int64         //请求体的最大字节数， 0表示不限制
+	timeout       time.Duration //handler的超时时间， 0表示不限制
+	errorRenderer ErrorRenderer //413和503的响应， 为nil时使用默认的文本响应
+	engine        *Engine
+}
+
+//路由名和元数据， 修改时复制后整体替换， 处理请求时不加锁读取
+type routeAttrs struct {
+	name string
+	meta map[string]interface{} //路由元数据， 如 owner、tags、scopes
+}
+
+var (
+	emptyAttrs = &routeAttrs{}
+	attrsMu    sync.Mutex //串行化Name和Meta的修改
+)
+
+func (route *Route) loadAttrs() *routeAttrs {
+	if attrs, ok := route.attrs.Load().(*routeAttrs); ok {
+		return attrs
+	}
+	return emptyAttrs
+}
+
+//第i个动态片段的约束函数， 没有约束时为nil
+func (route *Route) check(i int) func(string) bool {
+	if i < len(route.checks) {
+		return route.checks[i]
+	}
+	return nil
+}
+
+//路由的描述信息， 用于管理页面、测试和启动时输出
+type RouteInfo struct {
+	Host        string //Host注册的域名， 默认域名为空
+	Method      string
+	Path        string                 //注册时的完整路由， 如 /v1/user/:id
+	Name        string                 //路由名， 没有命名时为空
+	Handler     string                 //处理请求的handler的函数名
+	Middlewares []string               //handler之前的完整中间件链， 依次为组中间件和路由中间件
+	HandlerFunc HandlerFunc            //处理请求的handler
+	Meta        map[string]interface{} //路由元数据
+	Conditions  []string               //匹配条件， 如 header:X-Api-Version=2
+	BodyLimit   int64                  //请求体的最大字节数， 0表示不限制
+	Timeout     time.Duration          //handler的超时时间， 0表示不限制
+}
+
+//返回所有路由， 按域名、路由和请求方法排序
+func (engine *Engine) Routes() []RouteInfo {
+	infos := engine.router.routes("")
+	for _, h := range engine.loadHosts() {
+		infos = append(infos, h.router.routes(h.pattern)...)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Host < infos[j].Host
+	})
+	return infos
+}
+
+func (r *router) routes(host string) []RouteInfo {
+	infos := make([]RouteInfo, 0)
+	for method, root := range r.load().roots {
+		for _, route := range root.allRoutes() {
+			info := newRouteInfo(method, route)
+			info.Host = host
+			infos = append(infos, info)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool { //同一路由的多个条件保持查找顺序
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+		return infos[i].Method < infos[j].Method
+	})
+	return infos
+}
+
+func newRouteInfo(method string, route *Route) RouteInfo {
+	attrs := route.loadAttrs()
+	info := RouteInfo{Method: method, Path: route.pattern, Name: attrs.name, Meta: attrs.meta,
+		BodyLimit: route.bodyLimit, Timeout: route.timeout}
+	if len(route.conditions) > 0 {
+		info.Conditions = route.conditionDescs()
+	}
+	if len(route.handlers) == 0 {
+		return info
+	}
+	last := len(route.handlers) - 1
+	info.HandlerFunc = route.handlers[last]
+	info.Handler = nameOfFunction(info.HandlerFunc)
+	info.Middlewares = make([]string, last)
+	for i, h := range route.handlers[:last] {
+		info.Middlewares[i] = nameOfFunction(h)
+	}
+	return info
+}
+
+//通过函数指针获取函数名， 如 main.main.func1
+func nameOfFunction(f HandlerFunc) string {
+	if f == nil {
+		return ""
+	}
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+//给路由命名， 之后可以用 Engine.URL 或模板中的 urlFor 生成url
+func (route *Route) Name(name string) *Route {
+	if route.engine == nil {
+		panic(fmt.Sprintf("gee: route %q is not registered on an engine", route.pattern))
+	}
+	route.engine.mu.Lock()
+	defer route.engine.mu.Unlock()
+	if other, ok := route.engine.names[name]; ok && other != route {
+		panic(fmt.Sprintf("gee: route name %q is already used by %q", name, other.pattern))
+	}
+	attrsMu.Lock()
+	defer attrsMu.Unlock()
+	attrs := route.loadAttrs()
+	if attrs.name != "" {
+		delete(route.engine.names, attrs.name)
+	}
+	route.attrs.Store(&routeAttrs{name: name, meta: attrs.meta})
+	route.engine.names[name] = route
+	return route
+}
+
+//删除组所属域名下method请求方法、注册时路由为pattern的路由， 可以在服务运行时调用
+//pattern和注册时一样相对于组前缀， 如 v1.RemoveRoute("GET", "/user/:id") ； 返回是否删除了路由
+//r.RemoveRoute 删除默认域名的路由， r.Host(...).RemoveRoute 删除该域名的路由
+//路由在所有请求方法下都被删除后， 其路由名也不再可用
+func (group *RouterGroup) RemoveRoute(method string, pattern string) bool {
+	engine, router := group.engine, group.host.router
+	removed := router.removeRoute(method, group.prefix+pattern)
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	for _, route := range removed {
+		name := route.loadAttrs().name
+		if name != "" && engine.names[name] == route && !router.contains(route) {
+			delete(engine.names, name)
+		}
+	}
+	return len(removed) > 0
+}
+
+//给路由添加元数据， 如 Meta("owner", "payments").Meta("scopes", []string{"orders:read"})
+//中间件可以在handler执行前通过 Context.RouteMeta 读取
+//复制后整体替换， 已经读取到旧元数据的请求不受影响
+func (route *Route) Meta(key string, value interface{}) *Route {
+	attrsMu.Lock()
+	defer attrsMu.Unlock()
+	attrs := route.loadAttrs()
+	meta := make(map[string]interface{}, len(attrs.meta)+1)
+	for k, v := range attrs.meta {
+		meta[k] = v
+	}
+	meta[key] = value
+	route.attrs.Store(&routeAttrs{name: attrs.name, meta: meta})
+	return route
+}
+
+//根据路由名生成url， params为键值对， 如 URL("user.show", "id", "42")
+//参数值会被转义， *通配参数保留其中的 / ； 路由中没有的参数作为查询参数
+func (engine *Engine) URL(name string, params ...string) (string, error) {
+	engine.mu.RLock()
+	route, ok := engine.names[name]
+	engine.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("gee: no route named %q", name)
+	}
+	if len(params)%2 != 0 {
+		return "", fmt.Errorf("gee: odd number of params for route %q", name)
+	}
+
+	used := make([]bool, len(params)/2)
+	lookup := func(key string) (string, bool) {
+		for i := 0; i < len(params); i += 2 {
+			if params[i] == key {
+				used[i/2] = true
+				return params[i+1], true
+			}
+		}
+		return "", false
+	}
+
+	var b strings.Builder
+	p := route.pattern
+	optional := isOptional(p[strings.LastIndexByte(p, '/')+1:])
+	if optional {
+		p = p[:len(p)-1]
+	}
+	for w := 0; len(p) > 0; w++ {
+		i := nextWildcard(p)
+		if i < 0 {
+			b.WriteString(p)
+			break
+		}
+		b.WriteString(p[:i])
+		p = p[i:]
+		end := wildcardEnd(p)
+		part := p[:end]
+		p = p[end:]
+
+		key, constraint := parseWildcard(part)
+		value, ok := lookup(key)
+		if !ok || value == "" {
+			if optional && p == "" { //可选的最后一段没有值时去掉
+				path := strings.TrimRight(b.String(), "/")
+				b.Reset()
+				b.WriteString(path)
+				if path == "" {
+					b.WriteString("/")
+				}
+				break
+			}
+			return "", fmt.Errorf("gee: missing param %q for route %q", key, name)
+		}
+		if check := route.check(w); check != nil && !check(value) {
+			return "", fmt.Errorf("gee: param %q=%q does not match %q in route %q", key, value, constraint, name)
+		}
+
+		if part[0] == '*' {
+			segs := strings.Split(value, "/")
+			for i, seg := range segs {
+				segs[i] = url.PathEscape(seg)
+			}
+			b.WriteString(strings.Join(segs, "/"))
+		} else {
+			b.WriteString(url.PathEscape(value))
+		}
+	}
+
+	query := url.Values{}
+	for i, ok := range used {
+		if !ok {
+			query.Add(params[2*i], params[2*i+1])
+		}
+	}
+	if len(query) > 0 {
+		return b.String() + "?" + query.Encode(), nil
+	}
+	return b.String(), nil
+}
+
+//模板函数urlFor， 参数可以是任意类型
+func (engine *Engine) urlFor(name string, params ...interface{}) (string, error) {
+	pairs := make([]string, len(params))
+	for i, param := range params {
+		pairs[i] = fmt.Sprint(param)
+	}
+	return engine.URL(name, pairs...)
+}
@@ -1,20 +1,54 @@
 package gee
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+//修改路由时复制路由表， 改完后原子地替换， 查找时不加锁
+//正在处理的请求始终使用替换前的完整路由表
 type router struct {
-	roots map[string]*node //动态路由  前端树
-	handlers map[string]HandlerFunc
+	mu    sync.Mutex   //串行化路由的添加和删除
+	table atomic.Value //当前的*routeTable
+}
+
+//路由表， 发布后不再修改
+type routeTable struct {
+	roots     map[string]*node //每个请求方法一棵压缩前缀树
+	noRoute   *node            //各组的NoRoute， 按组前缀匹配
+	mounts    *node            //Mount的handler， 用于Any没有覆盖的请求方法
+	maxParams int              //单条路由最多的动态参数个数， 用于预分配Params
 }
 
 func newRouter() *router {
-	return &router{
-		roots:    make(map[string]*node),
-		handlers: make(map[string]HandlerFunc),
+	r := &router{}
+	r.table.Store(&routeTable{roots: make(map[string]*node)})
+	return r
+}
+
+//当前的路由表
+func (r *router) load() *routeTable {
+	return r.table.Load().(*routeTable)
+}
+
+//复制路由表， methods对应的树只复制根节点， 插入时再复制经过的节点， 其他方法的树共用
+func (t *routeTable) clone(methods ...string) *routeTable {
+	roots := make(map[string]*node, len(t.roots)+len(methods))
+	for m, root := range t.roots {
+		roots[m] = root
 	}
+	for _, method := range methods {
+		if root, ok := t.roots[method]; ok {
+			roots[method] = root.copy()
+		}
+	}
+	return &routeTable{roots: roots, noRoute: t.noRoute, mounts: t.mounts, maxParams: t.maxParams}
 }
 
 //例如url为 http://localhost:9999/hello/:name, pattern为 /hello/:name
@@ -34,51 +68,374 @@ func parsePattern(pattern string) []string {
 	return parts //[hello, :name]
 }
 
+//检查路由规则， 动态参数必须有名字， *和可选参数只能出现在最后一段
+func validatePattern(pattern string) {
+	vs := strings.Split(pattern, "/")
+	for i, val := range vs {
+		if val == "" {
+			continue
+		}
+		if val == ":" {
+			panic(fmt.Sprintf("gee: wildcard in route %q must have a name", pattern))
+		}
+		last := strings.Join(vs[i+1:], "") == ""
+		if val[0] == '*' && !last {
+			panic(fmt.Sprintf("gee: catch-all %q must be the last segment in route %q", val, pattern))
+		}
+		if strings.HasSuffix(val, "?") && !(last && isOptional(val)) {
+			panic(fmt.Sprintf("gee: optional wildcard %q must be a whole last segment in route %q", val, pattern))
+		}
+	}
+}
+
+//是否为可选的动态段， 如 :page? 、 {id:[0-9]+}? 和 *path?
+func isOptional(part string) bool {
+	if len(part) < 3 || part[len(part)-1] != '?' {
+		return false
+	}
+	switch part[0] {
+	case '*':
+		return true
+	case ':', '{':
+		return wildcardEnd(part) == len(part)-1
+	}
+	return false
+}
+
+func hasTrailingSlash(p string) bool {
+	return len(p) > 1 && p[len(p)-1] == '/'
+}
+
+//合并多余的斜杠， 如 //hello 变为 /hello
+func collapseSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+//清理路径， 处理多余的斜杠和 . .. ， 保留结尾的斜杠
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if cleaned != "/" && hasTrailingSlash(p) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+//根据引擎配置返回规范路径， 和path相同时不需要重定向
+func canonicalPath(engine *Engine, path string, pattern string) string {
+	if engine.RemoveExtraSlash {
+		path = collapseSlashes(path)
+	}
+	if engine.RedirectTrailingSlash && !strings.Contains(pattern, "*") && path != "/" {
+		if hasTrailingSlash(pattern) && !hasTrailingSlash(path) {
+			path += "/"
+		} else if !hasTrailingSlash(pattern) && hasTrailingSlash(path) {
+			path = strings.TrimRight(path, "/")
+		}
+	}
+	return path
+}
+
+//重定向到规范路径， GET用301， 其他方法用308以保留请求体
+//to开头的多个斜杠合并为一个， 避免 //evil.com 被浏览器当作其他域名； 路径转义后再拼接查询参数
+func redirect(c *Context, to string) {
+	to = "/" + strings.TrimLeft(to, "/")
+	if c.Path == c.Req.URL.Path { //UseRawPath时c.Path已经是转义后的路径
+		to = (&url.URL{Path: to}).EscapedPath()
+	}
+	if c.Req.URL.RawQuery != "" {
+		to += "?" + c.Req.URL.RawQuery
+	}
+	c.redirectTo = to
+	c.handlers = c.engine.redirectHandlers
+}
+
+//以下为未匹配到路由时的默认handler， 在Engine.rebuildFallbacks中和全局中间件合并
+func redirectHandler(c *Context) {
+	code := http.StatusMovedPermanently
+	if c.Method != http.MethodGet {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(c.Writer, c.Req, c.redirectTo, code)
+}
+
+func notFoundHandler(c *Context) {
+	c.String(http.StatusNotFound, "404 NOT FOUND: %s \n", c.Path)
+}
+
+func methodNotAllowedHandler(c *Context) {
+	c.String(http.StatusMethodNotAllowed, "405 METHOD NOT ALLOWED: %s \n", c.Path)
+}
+
+func optionsHandler(c *Context) {
+	c.Status(http.StatusNoContent)
+}
+
+//路径匹配但条件不满足， 状态码为406或415
+func rejectHandler(c *Context) {
+	code := c.rejectCode
+	c.String(code, "%d %s: %s \n", code, strings.ToUpper(http.StatusText(code)), c.Path)
+}
+
+//去掉多余和结尾的斜杠， 已经规范的路径直接返回， 不分配内存
+func trimPath(p string) string {
+	p = collapseSlashes(p)
+	if hasTrailingSlash(p) {
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
 //添加路由映射和路由前端树
-func (r *router) addRoute(method string, pattern string, handler HandlerFunc)  {
-	parts := parsePattern(pattern)
+func (r *router) addRoute(method string, pattern string, handlers ...HandlerFunc) *Route {
+	route := &Route{pattern: pattern, handlers: handlers}
+	r.insertRoute(route, method)
+	return route
+}
+
+//把路由注册到methods下， 可以在服务运行时调用
+//所有方法在同一个副本上修改后一起替换， 任意一个方法冲突时panic且路由表不变
+func (r *router) insertRoute(route *Route, methods ...string) {
+	r.update(route, false, methods)
+}
 
-	key := method + "-" + pattern
+//注册Mount的路由， 同时加入按前缀匹配其他请求方法的树
+func (r *router) insertMount(route *Route, methods ...string) {
+	r.update(route, true, methods)
+}
+
+func (r *router) update(route *Route, mount bool, methods []string) {
+	validatePattern(route.pattern)
+	route.checks = compileChecks(route.pattern)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.load().clone(methods...)
+	for _, method := range methods {
+		t.insert(method, route)
+	}
+	if mount {
+		t.mounts = replacePattern(t.mounts, route)
+	}
+	r.table.Store(t)
+}
 
-	_, ok := r.roots[method]
+func (t *routeTable) insert(method string, route *Route) {
+	_, ok := t.roots[method]
 	if !ok {
-		r.roots[method] = &node{}
+		t.roots[method] = &node{}
+	}
+	insertPattern(t.roots[method], route)
+
+	if params := countWildcards(route.pattern); params > t.maxParams {
+		t.maxParams = params
+	}
+}
+
+func insertPattern(root *node, route *Route) {
+	parts := parsePattern(route.pattern)
+	//可选的最后一段展开为两条， 如 /list/:page? 对应 /list 和 /list/:page， 共用原始路由和handler
+	if len(parts) > 0 && isOptional(parts[len(parts)-1]) {
+		last := parts[len(parts)-1]
+		parts[len(parts)-1] = last[:len(last)-1]
+		root.insert("/"+strings.Join(parts[:len(parts)-1], "/"), route)
+	}
+	root.insert("/"+strings.Join(parts, "/"), route)
+}
+
+//设置组的NoRoute， route.pattern为 组前缀/*path? ， 同一个组再次设置时替换
+//按前缀查找时静态部分优先， 所以前缀最长的组先匹配
+func (r *router) setNoRoute(route *Route) {
+	validatePattern(route.pattern)
+	route.checks = compileChecks(route.pattern)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.load().clone()
+	t.noRoute = replacePattern(t.noRoute, route)
+	r.table.Store(t)
+}
+
+//path对应的NoRoute， 没有设置时返回nil
+func (r *router) getNoRoute(path string) *Route {
+	return searchPrefix(r.load().noRoute, path, nil)
+}
+
+//path对应的Mount， 通配参数追加到params中， 没有时返回nil
+func (r *router) getMount(path string, params *Params) *Route {
+	return searchPrefix(r.load().mounts, path, params)
+}
+
+//复制一棵按前缀匹配的树并加入route， 已有相同pattern的路由时替换
+func replacePattern(root *node, route *Route) *node {
+	replaced := &node{}
+	if root != nil {
+		for _, other := range root.allRoutes() {
+			if other.pattern != route.pattern {
+				insertPattern(replaced, other)
+			}
+		}
 	}
-	r.roots[method].insert(pattern, parts, 0)
-	r.handlers[key] = handler
+	insertPattern(replaced, route)
+	return replaced
 }
 
+//复制一棵按前缀匹配的树并去掉route， 没有剩余路由时返回nil
+func withoutRoute(root *node, route *Route) *node {
+	if root == nil {
+		return nil
+	}
+	var rebuilt *node
+	for _, other := range root.allRoutes() {
+		if other == route {
+			continue
+		}
+		if rebuilt == nil {
+			rebuilt = &node{}
+		}
+		insertPattern(rebuilt, other)
+	}
+	return rebuilt
+}
 
-//返回节点和 动态路由对应的值的映射
-func (r *router) getRoute(method string, path string) (*node, map[string]string) {
-	searchParts := parsePattern(path)
-	params := make(map[string]string)
+func searchPrefix(root *node, path string, params *Params) *Route {
+	if root == nil {
+		return nil
+	}
+	n := root.search(trimPath(path), params, nil)
+	if n == nil {
+		return nil
+	}
+	return n.routes[0]
+}
 
-	root, ok := r.roots[method]
+//删除method下注册时路由为pattern的所有路由（包括条件不同的）， 返回被删除的路由
+//剩余的路由按原顺序重建该方法的树， 没有剩余路由时去掉该方法
+//Mount的路由在所有请求方法下都被删除后， 也不再处理其他请求方法
+func (r *router) removeRoute(method string, pattern string) []*Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.load()
+	root, ok := old.roots[method]
 	if !ok {
-		return nil, nil
+		return nil
 	}
 
-	n := root.search(searchParts, 0)
+	var removed []*Route
+	t := old.clone()
+	delete(t.roots, method)
+	for _, route := range root.allRoutes() {
+		if route.pattern == pattern {
+			removed = append(removed, route)
+			continue
+		}
+		t.insert(method, route)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	for _, route := range removed {
+		if !t.contains(route) {
+			t.mounts = withoutRoute(t.mounts, route)
+		}
+	}
+	r.table.Store(t)
+	return removed
+}
 
-	if n != nil {
-		parts := parsePattern(n.pattern)
-		for i, part := range parts{
-			if part[0] == ':' {
-				params[part[1:]] = searchParts[i]
-			}
-			if part[0] == '*' && len(part) > 1 {
-				params[part[1:]] = strings.Join(searchParts[i:], "/")
-				break
+//路由是否还注册在某个请求方法下
+func (r *router) contains(route *Route) bool {
+	return r.load().contains(route)
+}
+
+func (t *routeTable) contains(route *Route) bool {
+	for _, root := range t.roots {
+		for _, other := range root.allRoutes() {
+			if other == route {
+				return true
 			}
 		}
-		return n, params
 	}
-	return nil, nil
+	return false
+}
+
+//查找路由， 动态参数追加到params中， 静态路由的查找不分配内存
+//req不为nil时同时检查路由的匹配条件
+func (r *router) getValue(method string, path string, params *Params, req *http.Request) *node {
+	root, ok := r.load().roots[method]
+	if !ok {
+		return nil
+	}
+	return root.search(trimPath(path), params, req)
+}
+
+//返回节点和动态路由对应的参数
+func (r *router) getRoute(method string, path string) (*node, Params) {
+	params := make(Params, 0, r.load().maxParams)
+	n := r.getValue(method, path, &params, nil)
+	if n == nil {
+		return nil, nil
+	}
+	return n, params
+}
+
+//路径匹配但条件都不满足时的状态码， Content-Type不满足为415， Accept不满足为406， 其他为0
+func (r *router) conditionStatus(method string, path string, req *http.Request) int {
+	n, _ := r.getRoute(method, path)
+	if n == nil {
+		return 0
+	}
+	status := 0
+	for _, route := range n.routes {
+		switch route.failedStatus(req) {
+		case http.StatusUnsupportedMediaType:
+			return http.StatusUnsupportedMediaType
+		case http.StatusNotAcceptable:
+			status = http.StatusNotAcceptable
+		}
+	}
+	return status
+}
+
+//忽略静态片段的大小写查找路由， 同时返回按注册时大小写修正后的路径（没有结尾的斜杠）
+func (r *router) getValueFold(method string, path string, params *Params, req *http.Request) (*node, string) {
+	root, ok := r.load().roots[method]
+	if !ok {
+		return nil, ""
+	}
+	n, fixed := root.searchFold(trimPath(path), make([]byte, 0, len(path)+1), params, req)
+	if n == nil {
+		return nil, ""
+	}
+	return n, string(fixed)
+}
+
+//忽略大小写查找路由， 返回按注册时大小写修正后的路径
+func (r *router) findCaseInsensitivePath(method string, path string) (string, bool) {
+	n, fixed := r.getValueFold(method, path, nil, nil)
+	if n == nil {
+		return "", false
+	}
+	if hasTrailingSlash(n.pattern) && fixed != "/" {
+		fixed += "/"
+	}
+	return fixed, true
 }
 
 func (r *router) getRoutes(method string) []*node {
-	root, ok := r.roots[method]
+	root, ok := r.load().roots[method]
 	if !ok {
 		return nil
 	}
@@ -87,23 +444,124 @@ func (r *router) getRoutes(method string) []*node {
 	return nodes
 }
 
-//处理响应
-func (r *router) handle(c *Context)  {
-	n, params := r.getRoute(c.Method, c.Path)
+//返回能匹配path的所有请求方法
+//有GET时自动包含HEAD， autoOptions为true时包含OPTIONS
+func (r *router) allowedMethods(path string, autoOptions bool) []string {
+	allow := make([]string, 0)
+	for method := range r.load().roots {
+		if n, _ := r.getRoute(method, path); n != nil {
+			allow = append(allow, method)
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	if containsMethod(allow, http.MethodGet) && !containsMethod(allow, http.MethodHead) {
+		allow = append(allow, http.MethodHead)
+	}
+	if autoOptions && !containsMethod(allow, http.MethodOptions) {
+		allow = append(allow, http.MethodOptions)
+	}
+	sort.Strings(allow)
+	return allow
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+//对按RawPath匹配到的参数值解码， 无法解码时保留原值
+func unescapeParams(params Params) {
+	for i := range params {
+		if value, err := url.PathUnescape(params[i].Value); err == nil {
+			params[i].Value = value
+		}
+	}
+}
+
+//查找路由并设置handler链， 包括重定向、405和自动OPTIONS， 都不匹配时返回false
+func (r *router) handle(c *Context) bool {
+	method := c.Method
+	start := len(c.Params) //之前为域名参数
+	//精确查找， CaseInsensitive时再忽略大小写查找， fixed为按注册时大小写修正后的路径
+	lookup := func(method string) (n *node, fixed string) {
+		if n = r.getValue(method, c.Path, &c.Params, c.Req); n == nil && c.engine.CaseInsensitive {
+			n, fixed = r.getValueFold(method, c.Path, &c.Params, c.Req)
+		}
+		return n, fixed
+	}
+	n, fixed := lookup(method)
+	if n == nil && method == http.MethodHead {
+		//没有注册HEAD时使用GET的handler， 丢弃响应体
+		if n, fixed = lookup(http.MethodGet); n != nil {
+			method = http.MethodGet
+			c.Writer = headResponseWriter{c.Writer}
+		}
+	}
+
+	if n == nil && !containsMethod(anyMethods, method) {
+		//Any没有覆盖的请求方法， 如PROPFIND， 交给挂载的handler； 标准方法只按各自的路由树匹配
+		if mount := r.getMount(c.Path, &c.Params); mount != nil {
+			c.handlers = mount.handlers
+			c.route = mount
+			return true
+		}
+	}
+
+	var route *Route
 	if n != nil {
-		c.Params = params //为Context的Params赋值
+		route = n.matchRoute(c.Req)
+		path := c.Path
+		if fixed != "" && c.engine.RedirectCaseInsensitive {
+			path = fixed
+			if hasTrailingSlash(c.Path) && fixed != "/" {
+				path += "/"
+			}
+		}
+		if to := canonicalPath(c.engine, path, route.pattern); to != c.Path {
+			redirect(c, to)
+			return true
+		}
+	} else if c.engine.RedirectFixedPath {
+		if fixed, ok := r.findCaseInsensitivePath(method, cleanPath(c.Path)); ok && fixed != c.Path {
+			redirect(c, fixed)
+			return true
+		}
+	}
 
-		key := c.Method + "-" + n.pattern
-		//r.handlers[key](c)  //根据路由调用对应handler
-		c.handlers = append(c.handlers, r.handlers[key])
+	var status int
+	var allow []string
+	if n == nil {
+		status = r.conditionStatus(method, c.Path, c.Req)
+	}
+	if n == nil && status == 0 && (c.engine.HandleMethodNotAllowed || method == http.MethodOptions && c.engine.HandleOptions) {
+		allow = r.allowedMethods(c.Path, c.engine.HandleOptions)
+		if matched, _ := r.getRoute(method, c.Path); matched != nil { //路径和方法都匹配， 只是条件不满足， 按404处理
+			allow = nil
+		}
+	}
+	if n != nil {
+		c.handlers = route.handlers //根据路由调用对应handler链
+		c.route = route
+		if c.engine.UnescapePathValues && c.Path != c.Req.URL.Path {
+			unescapeParams(c.Params[start:])
+		}
+	}else if status != 0 {
+		c.rejectCode = status
+		c.handlers = c.engine.rejectHandlers
+	}else if len(allow) > 0 && method == http.MethodOptions && c.engine.HandleOptions {
+		c.SetHeader("Allow", strings.Join(allow, ", "))
+		c.handlers = c.engine.optionsHandlers
+	}else if len(allow) > 0 && c.engine.HandleMethodNotAllowed {
+		c.SetHeader("Allow", strings.Join(allow, ", "))
+		c.handlers = c.engine.noMethodHandlers
 	}else {
-		c.handlers = append(c.handlers, func(c *Context) {
-			c.String(http.StatusNotFound, "404 NOT FOUND: %s \n", c.Path)
-		})
+		return false
 	}
-	//fmt.Println("hsz1")
-	//通过context调用handlerFunc
-	c.Next()
-	//fmt.Println("hsz11")
+	return true
 }
-
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func newTestRouter() *router {
@@ -37,24 +38,24 @@ func TestGetRoute(t *testing.T) {
 		t.Fatal("should match /hello/:name")
 	}
 
-	if ps["name"] != "geektutu" {
+	if ps.ByName("name") != "geektutu" {
 		t.Fatal("name should be equal to 'geektutu'")
 	}
 
-	fmt.Printf("matched path: %s, params['name']: %s\n", n.pattern, ps["name"])
+	fmt.Printf("matched path: %s, params['name']: %s\n", n.pattern, ps.ByName("name"))
 
 }
 
 func TestGetRoute2(t *testing.T) {
 	r := newTestRouter()
 	n1, ps1 := r.getRoute("GET", "/assets/file1.txt")
-	ok1 := n1.pattern == "/assets/*filepath" && ps1["filepath"] == "file1.txt"
+	ok1 := n1.pattern == "/assets/*filepath" && ps1.ByName("filepath") == "file1.txt"
 	if !ok1 {
 		t.Fatal("pattern shoule be /assets/*filepath & filepath shoule be file1.txt")
 	}
 
 	n2, ps2 := r.getRoute("GET", "/assets/css/test.css")
-	ok2 := n2.pattern == "/assets/*filepath" && ps2["filepath"] == "css/test.css"
+	ok2 := n2.pattern == "/assets/*filepath" && ps2.ByName("filepath") == "css/test.css"
 	if !ok2 {
 		t.Fatal("pattern shoule be /assets/*filepath & filepath shoule be css/test.css")
 	}
@@ -71,4 +72,354 @@ func TestGetRoutes(t *testing.T) {
 	if len(nodes) != 5 {
 		t.Fatal("the number of routes shoule be 4")
 	}
-}
\ No newline at end of file
+}
+func TestAddRouteConflict(t *testing.T) {
+	cases := [][]string{
+		{"/user/:id", "/user/:name/profile"},
+		{"/assets/*filepath", "/assets/*path"},
+		{"/hello", "/hello"},
+		{"/hello", "/hello/"},
+		{"/static/*filepath/x"},
+		{"/user/:"},
+	}
+	for _, patterns := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("registering %v should panic", patterns)
+				}
+			}()
+			r := newRouter()
+			for _, pattern := range patterns {
+				r.addRoute("GET", pattern, nil)
+			}
+		}()
+	}
+
+	r := newRouter()
+	r.addRoute("GET", "/user/:id", nil)
+	r.addRoute("GET", "/user/:id/profile", nil)
+	r.addRoute("POST", "/user/:name", nil)
+	r.addRoute("GET", "/static/*filepath", nil)
+	r.addRoute("GET", "/static/favicon.ico", nil)
+	if len(r.getRoutes("GET")) != 4 {
+		t.Fatal("static route registered after catch-all should not overwrite it")
+	}
+	if n, ps := r.getRoute("GET", "/static/css/a.css"); n == nil || ps.ByName("filepath") != "css/a.css" {
+		t.Fatal("catch-all route should still match")
+	}
+}
+
+func TestMatchPriority(t *testing.T) {
+	patterns := []string{
+		"/hello/b/c",
+		"/hello/:name/c",
+		"/hello/:name/d",
+		"/src/*filepath",
+		"/src/a/b",
+		"/src/favicon.ico",
+		"/files/:name",
+		"/files/*filepath",
+		"/files/:name/meta",
+		"/img/:id<int>",
+		"/img/*path",
+	}
+	cases := []struct {
+		path, pattern string
+	}{
+		{"/hello/b/c", "/hello/b/c"},
+		{"/hello/x/c", "/hello/:name/c"},
+		{"/hello/b/d", "/hello/:name/d"},
+		{"/src/favicon.ico", "/src/favicon.ico"},
+		{"/src/a/b", "/src/a/b"},
+		{"/src/a/c", "/src/*filepath"},
+		{"/src/a", "/src/*filepath"},
+		{"/files/a", "/files/:name"},
+		{"/files/a/meta", "/files/:name/meta"},
+		{"/files/a/b", "/files/*filepath"},
+		{"/files/a/meta/x", "/files/*filepath"},
+		{"/img/12", "/img/:id<int>"},
+		{"/img/abc", "/img/*path"},
+	}
+	//正序和倒序注册结果应一致
+	for _, reverse := range []bool{false, true} {
+		r := newRouter()
+		for i := range patterns {
+			if reverse {
+				i = len(patterns) - 1 - i
+			}
+			r.addRoute("GET", patterns[i], nil)
+		}
+		for _, tc := range cases {
+			n, _ := r.getRoute("GET", tc.path)
+			if n == nil || n.pattern != tc.pattern {
+				t.Fatalf("reverse=%t: %s should match %s, got %v", reverse, tc.path, tc.pattern, n)
+			}
+		}
+	}
+}
+
+func TestRadixTree(t *testing.T) {
+	r := newRouter()
+	patterns := []string{
+		"/", "/search", "/support", "/src/*filepath", "/s/:name",
+		"/user_:name", "/users/:id", "/users/:id/posts/:post", "/users/new",
+	}
+	for _, pattern := range patterns {
+		r.addRoute("GET", pattern, nil)
+	}
+	cases := []struct {
+		path, pattern string
+		params        Params
+	}{
+		{"/", "/", Params{}},
+		{"/search", "/search", Params{}},
+		{"/support", "/support", Params{}},
+		{"/sea", "", nil},
+		{"/src/a/b.go", "/src/*filepath", Params{{"filepath", "a/b.go"}}},
+		{"/s/gee", "/s/:name", Params{{"name", "gee"}}},
+		{"/user_gee", "/user_:name", Params{{"name", "gee"}}},
+		{"/users/new", "/users/new", Params{}},
+		{"/users/42", "/users/:id", Params{{"id", "42"}}},
+		{"/users/42/posts/7", "/users/:id/posts/:post", Params{{"id", "42"}, {"post", "7"}}},
+		{"/users/new/posts/7", "/users/:id/posts/:post", Params{{"id", "new"}, {"post", "7"}}},
+	}
+	for _, tc := range cases {
+		n, ps := r.getRoute("GET", tc.path)
+		if tc.pattern == "" {
+			if n != nil {
+				t.Fatalf("%s should not match, got %s", tc.path, n.pattern)
+			}
+			continue
+		}
+		if n == nil || n.pattern != tc.pattern || !reflect.DeepEqual(ps, tc.params) {
+			t.Fatalf("%s should match %s with %v, got %v %v", tc.path, tc.pattern, tc.params, n, ps)
+		}
+	}
+	if len(r.getRoutes("GET")) != len(patterns) {
+		t.Fatalf("the number of routes should be %d", len(patterns))
+	}
+}
+
+func TestParamsGet(t *testing.T) {
+	ps := Params{{"id", "1"}, {"name", "gee"}, {"id", "2"}}
+	if v, ok := ps.Get("id"); !ok || v != "1" {
+		t.Fatal("Get should return the first param named id")
+	}
+	if _, ok := ps.Get("missing"); ok {
+		t.Fatal("Get should report missing params")
+	}
+	if ps.ByName("name") != "gee" || ps.ByName("missing") != "" {
+		t.Fatal("ByName returns the value or an empty string")
+	}
+}
+
+func TestStaticRouteZeroAlloc(t *testing.T) {
+	r := newBenchRouter()
+	params := make(Params, 0, r.load().maxParams)
+	allocs := testing.AllocsPerRun(100, func() {
+		params = params[:0]
+		r.getValue("GET", "/api/v1/users", &params, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("static route lookup should not allocate, got %v allocs", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		params = params[:0]
+		r.getValue("GET", "/api/v1/users/42/posts", &params, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("param route lookup with a reused Params should not allocate, got %v allocs", allocs)
+	}
+}
+
+func newBenchRouter() *router {
+	r := newRouter()
+	for _, pattern := range []string{
+		"/", "/hello/:name", "/hello/b/c", "/hi/:name", "/assets/*filepath",
+		"/api/v1/users", "/api/v1/users/:id", "/api/v1/users/:id/posts",
+		"/api/v1/posts/:id/comments", "/about", "/contact",
+	} {
+		r.addRoute("GET", pattern, nil)
+	}
+	return r
+}
+
+func BenchmarkStaticRoute(b *testing.B) {
+	r := newBenchRouter()
+	params := make(Params, 0, r.load().maxParams)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		params = params[:0]
+		r.getValue("GET", "/api/v1/users", &params, nil)
+	}
+}
+
+func BenchmarkParamRoute(b *testing.B) {
+	r := newBenchRouter()
+	params := make(Params, 0, r.load().maxParams)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		params = params[:0]
+		r.getValue("GET", "/api/v1/users/42/posts", &params, nil)
+	}
+}
+
+func BenchmarkAddRoutes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := newRouter()
+		for j := 0; j < 1000; j++ {
+			r.addRoute("GET", fmt.Sprintf("/api/v%d/users/:id/posts/%d", j%10, j), nil)
+		}
+	}
+}
+
+//注册路由时只复制经过的节点， 其他子树和旧的路由表共用， 大量注册不会退化为平方复杂度
+func TestAddRouteCopiesPath(t *testing.T) {
+	r := newRouter()
+	for i := 0; i < 5000; i++ {
+		r.addRoute("GET", fmt.Sprintf("/svc%d/items/:id/%d", i%50, i), nil)
+	}
+	for _, path := range []string{"/svc0/items/1/0", "/svc49/items/x/4999", "/svc7/items/y/1257"} {
+		if n, _ := r.getRoute("GET", path); n == nil {
+			t.Fatalf("%s should match", path)
+		}
+	}
+
+	old := r.load().roots["GET"]
+	r.addRoute("GET", "/svc3/items/:id/new", nil)
+	root := r.load().roots["GET"]
+	if root == old {
+		t.Fatal("the root on the insert path should be copied")
+	}
+	if root.search("/svc4/items/1/4", nil, nil) != old.search("/svc4/items/1/4", nil, nil) {
+		t.Fatal("subtrees off the insert path should be shared with the old table")
+	}
+	if root.search("/svc3/items/1/new", nil, nil) == nil || old.search("/svc3/items/1/new", nil, nil) != nil {
+		t.Fatal("the new route should only be visible in the new table")
+	}
+}
+
+func TestParamConstraints(t *testing.T) {
+	RegisterConstraint("date", func(s string) bool {
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	})
+	r := newRouter()
+	r.addRoute("GET", "/user/:id<int>", nil)
+	r.addRoute("GET", "/user/:name", nil)
+	r.addRoute("GET", "/user/new", nil)
+	r.addRoute("GET", "/file/:slug<[a-z0-9-]+>", nil)
+	r.addRoute("GET", "/post/{id:[0-9]+}/edit", nil)
+	r.addRoute("GET", "/post/:slug<alpha>/edit", nil)
+	r.addRoute("GET", "/archive/:day<date>", nil)
+	r.addRoute("GET", "/item/:id<uuid>", nil)
+
+	cases := []struct {
+		path, pattern, key, value string
+	}{
+		{"/user/42", "/user/:id<int>", "id", "42"},
+		{"/user/abc", "/user/:name", "name", "abc"},
+		{"/user/new", "/user/new", "", ""},
+		{"/file/my-file-1", "/file/:slug<[a-z0-9-]+>", "slug", "my-file-1"},
+		{"/file/My_File", "", "", ""},
+		{"/post/12/edit", "/post/{id:[0-9]+}/edit", "id", "12"},
+		{"/post/hello/edit", "/post/:slug<alpha>/edit", "slug", "hello"},
+		{"/post/hello-1/edit", "", "", ""},
+		{"/archive/2020-02-29", "/archive/:day<date>", "day", "2020-02-29"},
+		{"/archive/2021-02-29", "", "", ""},
+		{"/item/123e4567-e89b-12d3-a456-426614174000", "/item/:id<uuid>", "id", "123e4567-e89b-12d3-a456-426614174000"},
+		{"/item/42", "", "", ""},
+	}
+	for _, tc := range cases {
+		n, ps := r.getRoute("GET", tc.path)
+		if tc.pattern == "" {
+			if n != nil {
+				t.Fatalf("%s should not match, got %s", tc.path, n.pattern)
+			}
+			continue
+		}
+		if n == nil || n.pattern != tc.pattern || ps.ByName(tc.key) != tc.value {
+			t.Fatalf("%s should match %s with %s=%s, got %v %v", tc.path, tc.pattern, tc.key, tc.value, n, ps)
+		}
+	}
+
+	for _, patterns := range [][]string{
+		{"/user/:id<int>", "/user/:num<int>"},
+		{"/user/:id<[0-9]+>", "/user/{num:[0-9]+}"},
+		{"/user/:id<[0-9>"},
+		{"/user/{id"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("registering %v should panic", patterns)
+				}
+			}()
+			r := newRouter()
+			for _, pattern := range patterns {
+				r.addRoute("GET", pattern, nil)
+			}
+		}()
+	}
+}
+
+func TestMixedSegmentParams(t *testing.T) {
+	r := newRouter()
+	r.addRoute("GET", "/v:version/items", nil)
+	r.addRoute("GET", "/videos", nil)
+	r.addRoute("GET", "/files/:name.:ext", nil)
+	r.addRoute("GET", "/files/:name", nil)
+	r.addRoute("GET", "/avatar/:user.png", nil)
+	r.addRoute("GET", "/avatar/:user<int>.jpg", nil)
+	r.addRoute("GET", "/avatar/default.png", nil)
+	r.addRoute("GET", "/report-{year:[0-9]{4}}.csv", nil)
+
+	cases := []struct {
+		path, pattern string
+		params        Params
+	}{
+		{"/v2/items", "/v:version/items", Params{{"version", "2"}}},
+		{"/videos", "/videos", Params{}},
+		{"/files/a.txt", "/files/:name.:ext", Params{{"name", "a"}, {"ext", "txt"}}},
+		{"/files/a.tar.gz", "/files/:name.:ext", Params{{"name", "a.tar"}, {"ext", "gz"}}},
+		{"/files/readme", "/files/:name", Params{{"name", "readme"}}},
+		{"/avatar/bob.png", "/avatar/:user.png", Params{{"user", "bob"}}},
+		{"/avatar/default.png", "/avatar/default.png", Params{}},
+		{"/avatar/42.jpg", "/avatar/:user<int>.jpg", Params{{"user", "42"}}},
+		{"/avatar/bob.jpg", "", nil},
+		{"/avatar/.png", "", nil},
+		{"/report-2020.csv", "/report-{year:[0-9]{4}}.csv", Params{{"year", "2020"}}},
+	}
+	for _, tc := range cases {
+		n, ps := r.getRoute("GET", tc.path)
+		if tc.pattern == "" {
+			if n != nil {
+				t.Fatalf("%s should not match, got %s", tc.path, n.pattern)
+			}
+			continue
+		}
+		if n == nil || n.pattern != tc.pattern || !reflect.DeepEqual(ps, tc.params) {
+			t.Fatalf("%s should match %s with %v, got %v %v", tc.path, tc.pattern, tc.params, n, ps)
+		}
+	}
+
+	for _, patterns := range [][]string{
+		{"/files/:name.:ext", "/files/:file.:ext"},
+		{"/v:version", "/v:ver/items"},
+		{"/files/:name:ext"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("registering %v should panic", patterns)
+				}
+			}()
+			r := newRouter()
+			for _, pattern := range patterns {
+				r.addRoute("GET", pattern, nil)
+			}
+		}()
+	}
+}
@@ -2,91 +2,424 @@ package gee
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 )
 
+//动态路由参数， 如 :name 对应的键值对
+type Param struct {
+	Key   string
+	Value string
+}
+
+//按路由中出现的顺序保存参数， Context复用同一个切片， 查找时不分配内存
+type Params []Param
+
+//返回第一个名为name的参数
+func (ps Params) Get(name string) (string, bool) {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+//返回名为name的参数， 不存在时为空字符串
+func (ps Params) ByName(name string) string {
+	value, _ := ps.Get(name)
+	return value
+}
+
+//压缩前缀树（radix tree）的节点
+//静态节点按公共前缀合并， 如 /hello/b/c 和 /hi/:name 共用前缀 /h
 type node struct {
-	pattern string //待匹配路由， 如 /p/:lang
-	part 	string //路由中的一部分， 如 :lang
-	children []*node //子节点， 如 [doc, intro]
-	isWild 	bool //是否精确匹配， part含有:和*时为true
+	pattern    string            //待匹配路由， 如 /p/:lang， 非空时表示该节点对应一条路由
+	part       string            //节点对应的片段， 静态节点为压缩后的前缀， 如 /p/ ； 动态节点为 :lang 或 *filepath
+	children   []*node           //静态子节点
+	indices    string            //静态子节点part的首字符， 与children一一对应， 用于快速查找
+	params     []*node           //:参数子节点， 带约束的排在前面， 同一位置最多一个不带约束
+	catchAll   *node             //*通配子节点， 同一位置只能有一个
+	isWild     bool              //是否为动态节点， part以:、{或*开头时为true
+	key        string            //动态节点的参数名
+	constraint string            //动态节点的约束， 如 int 或 [a-z]+
+	check      func(string) bool //约束对应的匹配函数， 为nil时不限制
+	mixed      bool              //参数节点后面是否有同一段内的静态后缀， 如 :user.png
+	routes     []*Route          //该位置的路由， 按条件个数从多到少依次检查， 不带条件的在最后
 }
 
 func (n *node) String() string {
 	return fmt.Sprintf("node{pattern=%s, part=%s, isWild=%t}", n.pattern, n.part, n.isWild)
 }
 
+//下一个动态片段的位置
+//:和{可以出现在一段的中间， 如 /v:version 和 /files/:name.:ext ； *只在一段的开头生效
+func nextWildcard(path string) int {
+	for i := 0; i < len(path); i++ {
+		if path[i] == ':' || path[i] == '{' || path[i] == '*' && (i == 0 || path[i-1] == '/') {
+			return i
+		}
+	}
+	return -1
+}
+
+//动态片段的结束位置， path以动态片段开头
+//:name 的名字只包含字母、数字和下划线， 之后可以跟<约束>； {}和<>按括号配对
+func wildcardEnd(path string) int {
+	switch path[0] {
+	case '*':
+		if end := strings.IndexByte(path, '/'); end >= 0 {
+			return end
+		}
+		return len(path)
+	case '{':
+		return closingBracket(path, '{', '}')
+	}
+	i := 1
+	for i < len(path) && isNameChar(path[i]) {
+		i++
+	}
+	if i < len(path) && path[i] == '<' {
+		i += closingBracket(path[i:], '<', '>')
+	}
+	return i
+}
+
+//返回与path[0]配对的右括号之后的位置， 没有配对时到这一段的结尾
+func closingBracket(path string, open byte, close byte) int {
+	depth := 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case open:
+			depth++
+		case close:
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case '/':
+			return i
+		}
+	}
+	return len(path)
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+//路由中动态片段的个数
+func countWildcards(path string) int {
+	count := 0
+	for i := nextWildcard(path); i >= 0; i = nextWildcard(path) {
+		path = path[i+wildcardEnd(path[i:]):]
+		count++
+	}
+	return count
+}
+
+//插入路由， path为规范化后的路由（没有多余和结尾的斜杠）， route.pattern为注册时的原始路由
+//n必须是已经复制的节点， 经过的子节点先复制再修改， 其他子树和原来的树共用
+func (n *node) insert(path string, route *Route) {
+	pattern := route.pattern
+	for w := 0; len(path) > 0; w++ {
+		i := nextWildcard(path)
+		if i < 0 {
+			n = n.insertStatic(path)
+			break
+		}
+		if i > 0 {
+			n = n.insertStatic(path[:i])
+			path = path[i:]
+		}
+		end := wildcardEnd(path)
+		n = n.insertWild(path[:end], pattern, route.check(w))
+		path = path[end:]
+		if len(path) > 0 && (path[0] == ':' || path[0] == '{') { //如 /:a:b 无法区分两个参数
+			panic(fmt.Sprintf("gee: wildcards in route %q must be separated by static text", pattern))
+		}
+	}
 
-func (n *node) insert(pattern string, parts []string, height int) {
-	if len(parts) == height { //parts为空时或为结束递归条件（len（parts）=1， height=0，执行一次后len（parts）= height+1）
+	signature := route.signature()
+	for _, existing := range n.routes {
+		if existing.signature() == signature { //同一位置已有条件相同的路由， 如 /hello 和 /hello/
+			panic(fmt.Sprintf("gee: route %q conflicts with existing route %q", pattern, existing.pattern))
+		}
+	}
+	if n.pattern == "" {
 		n.pattern = pattern
-		return
 	}
-	
-	part := parts[height]
-	child := n.matchChild(part)
-	if child == nil { //没有该节点就新建
-		child = &node{
-			part:     part,
-			isWild:   part[0] == ':' || part[0] == '*',
+	n.routes = append(n.routes, route)
+	for i := len(n.routes) - 1; i > 0 && len(n.routes[i-1].conditions) < len(route.conditions); i-- { //条件多的路由先检查
+		n.routes[i-1], n.routes[i] = route, n.routes[i-1]
+	}
+}
+
+//第一个满足请求条件的路由， req为nil时不检查条件
+func (n *node) matchRoute(req *http.Request) *Route {
+	for _, route := range n.routes {
+		if req == nil || route.matches(req) {
+			return route
+		}
+	}
+	return nil
+}
+
+//插入静态片段， 必要时拆分已有节点， 返回片段结束处的节点
+func (n *node) insertStatic(path string) *node {
+	for {
+		i := strings.IndexByte(n.indices, path[0])
+		if i < 0 { //没有公共前缀就新建
+			if n.isWild && path[0] != '/' { //参数后面紧跟静态后缀， 如 :name.:ext 中的 .
+				n.mixed = true
+			}
+			child := &node{part: path}
+			n.indices += string(path[0])
+			n.children = append(n.children, child)
+			return child
+		}
+
+		child := n.children[i].copy()
+		n.children[i] = child
+		l := commonPrefix(child.part, path)
+		if l < len(child.part) { //拆分节点， 原节点的内容移到后半段
+			tail := *child
+			tail.part = child.part[l:]
+			*child = node{
+				part:     child.part[:l],
+				children: []*node{&tail},
+				indices:  string(tail.part[0]),
+			}
+		}
+		if l == len(path) {
+			return child
+		}
+		n, path = child, path[l:]
+	}
+}
+
+//插入动态片段， 同一位置已有冲突的动态片段时panic
+//参数名和约束都相同时复用节点， 约束不同的参数可以并存， 查找时依次尝试
+//:参数和*通配也可以并存， 如 /static/:name 和 /static/*filepath ， 参数匹配不了时才使用通配
+//check为注册时编译的约束函数， 新建参数节点时使用
+func (n *node) insertWild(part string, pattern string, check func(string) bool) *node {
+	key, constraint := parseWildcard(part)
+	if part[0] == '*' {
+		if n.catchAll == nil {
+			n.catchAll = &node{part: part, isWild: true, key: key}
+		} else if n.catchAll.key != key {
+			panic(fmt.Sprintf("gee: wildcard %q in route %q conflicts with %q in existing route %q",
+				part, pattern, n.catchAll.part, n.catchAll.firstPattern()))
+		} else {
+			n.catchAll = n.catchAll.copy()
+		}
+		return n.catchAll
+	}
+
+	for i, child := range n.params {
+		if child.constraint != constraint {
+			continue
 		}
+		if child.key != key { //如 /user/:id 和 /user/:name/profile 冲突
+			panic(fmt.Sprintf("gee: wildcard %q in route %q conflicts with %q in existing route %q",
+				part, pattern, child.part, child.firstPattern()))
+		}
+		n.params[i] = child.copy()
+		return n.params[i]
+	}
 
-		n.children = append(n.children, child)
+	child := &node{part: part, isWild: true, key: key, constraint: constraint, check: check}
+	n.params = append(n.params, child)
+	if child.check != nil { //不带约束的参数放到最后
+		last := len(n.params) - 1
+		if last > 0 && n.params[last-1].check == nil {
+			n.params[last-1], n.params[last] = child, n.params[last-1]
+		}
 	}
-	child.insert(pattern, parts, height+1)
+	return child
 }
 
-//strings.HasPrefix测试字符串是否以prefix开头
-func (n *node) search(parts []string, height int) *node {
-	if len(parts) == height || strings.HasPrefix(n.part, "*") { //parts为空时 或 为结束递归条件 或 parts为*
-		if n.pattern == "" {
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+//查找路由， path为节点之后剩余的路径， 动态参数追加到params中
+//顺序为静态节点、:参数、*通配， 前面的分支走不通时回溯到后面的分支
+//req不为nil时还要满足路由的条件， 不满足时同样回溯
+func (n *node) search(path string, params *Params, req *http.Request) *node {
+	if path == "" {
+		if n.matchRoute(req) == nil {
 			return nil
 		}
 		return n
 	}
 
-	part := parts[height]
-	children := n.matchChildren(part)
+	if i := strings.IndexByte(n.indices, path[0]); i >= 0 {
+		child := n.children[i]
+		if strings.HasPrefix(path, child.part) {
+			if result := child.search(path[len(child.part):], params, req); result != nil {
+				return result
+			}
+		}
+	}
+
+	if len(n.params) > 0 {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		for _, child := range n.params {
+			for e := child.nextEnd(path, end, -1); e > 0; e = child.nextEnd(path, end, e) {
+				if child.check != nil && !child.check(path[:e]) {
+					continue //不满足约束时尝试下一个分支
+				}
+				if params != nil {
+					*params = append(*params, Param{Key: child.key, Value: path[:e]})
+				}
+				if result := child.search(path[e:], params, req); result != nil {
+					return result
+				}
+				if params != nil {
+					*params = (*params)[:len(*params)-1]
+				}
+			}
+		}
+	}
 
-	for _, child := range children{
-		result := child.search(parts, height+1)
-		if result != nil {
-			return result
+	if child := n.catchAll; child != nil && child.matchRoute(req) != nil {
+		if params != nil && child.key != "" {
+			*params = append(*params, Param{Key: child.key, Value: path})
 		}
+		return child
 	}
 
 	return nil
 }
 
-//获取所有节点
-func (n *node) travel(list *([]*node))  {
-	if n.pattern != "" {
-		*list = append(*list, n)
+//参数值的下一个候选结束位置， e为-1时返回第一个， 返回0表示没有了
+//先从右往左尝试同一段内各静态后缀的起点， 最后尝试整段， 所以 :name.:ext 匹配 a.tar.gz 时 name=a.tar
+func (n *node) nextEnd(path string, end int, e int) int {
+	if e == end {
+		return 0
 	}
-
-	for _, child := range n.children{
-		child .travel(list)
+	if e < 0 {
+		e = end
+	}
+	if n.mixed {
+		for e--; e > 0; e-- {
+			if strings.IndexByte(n.indices, path[e]) >= 0 {
+				return e
+			}
+		}
 	}
+	return end
 }
 
-//第一个匹配成功的节点， 用于插入
-func (n *node) matchChild(part string) *node {
-	for _, child := range n.children {
-		if child.part == part || child.isWild {
-			return child
+//忽略大小写查找， fixed记录按注册时大小写修正后的路径， 参数值保持请求中的大小写
+//params和req的用法同search
+func (n *node) searchFold(path string, fixed []byte, params *Params, req *http.Request) (*node, []byte) {
+	if path == "" {
+		if n.matchRoute(req) == nil {
+			return nil, nil
 		}
+		return n, fixed
 	}
 
-	return nil
+	for i := 0; i < len(n.indices); i++ {
+		child := n.children[i]
+		if len(path) < len(child.part) || !strings.EqualFold(path[:len(child.part)], child.part) {
+			continue
+		}
+		if result, segs := child.searchFold(path[len(child.part):], append(fixed, child.part...), params, req); result != nil {
+			return result, segs
+		}
+	}
+
+	if len(n.params) > 0 {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		for _, child := range n.params {
+			for e := child.nextEnd(path, end, -1); e > 0; e = child.nextEnd(path, end, e) {
+				if child.check != nil && !child.check(path[:e]) {
+					continue
+				}
+				if params != nil {
+					*params = append(*params, Param{Key: child.key, Value: path[:e]})
+				}
+				if result, segs := child.searchFold(path[e:], append(fixed, path[:e]...), params, req); result != nil {
+					return result, segs
+				}
+				if params != nil {
+					*params = (*params)[:len(*params)-1]
+				}
+			}
+		}
+	}
+
+	if child := n.catchAll; child != nil && child.matchRoute(req) != nil {
+		if params != nil && child.key != "" {
+			*params = append(*params, Param{Key: child.key, Value: path})
+		}
+		return child, append(fixed, path...)
+	}
+
+	return nil, nil
+}
+
+//复制节点本身， 子节点、路由和约束函数共用， 修改副本不影响原来的树
+func (n *node) copy() *node {
+	c := *n
+	c.children = append([]*node(nil), n.children...)
+	c.params = append([]*node(nil), n.params...)
+	c.routes = append([]*Route(nil), n.routes...)
+	return &c
 }
 
-//所有匹配成功的节点， 用于查找
-func (n *node) matchChildren(part string) []*node {
+//子树中的所有路由， 可选参数的路由只出现一次
+func (n *node) allRoutes() []*Route {
 	nodes := make([]*node, 0)
-	for _, child := range n.children{
-		if child.part == part || child.isWild {
-			nodes = append(nodes, child)
+	n.travel(&nodes)
+	routes := make([]*Route, 0, len(nodes))
+	seen := make(map[*Route]bool)
+	for _, n := range nodes {
+		for _, route := range n.routes {
+			if !seen[route] {
+				seen[route] = true
+				routes = append(routes, route)
+			}
 		}
 	}
-	return nodes
-}
\ No newline at end of file
+	return routes
+}
+
+//获取所有节点
+func (n *node) travel(list *([]*node)) {
+	if n.pattern != "" {
+		*list = append(*list, n)
+	}
+
+	for _, child := range n.children {
+		child.travel(list)
+	}
+	for _, child := range n.params {
+		child.travel(list)
+	}
+	if n.catchAll != nil {
+		n.catchAll.travel(list)
+	}
+}
+
+//返回子树中第一个路由， 用于冲突提示
+func (n *node) firstPattern() string {
+	nodes := make([]*node, 0)
+	n.travel(&nodes)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0].pattern
+}